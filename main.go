@@ -1,12 +1,24 @@
 package main
 
 import (
+	"os"
+
 	"quick-terminal/server/app"
+	"quick-terminal/server/cli"
 
 	"github.com/labstack/gommon/log"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := cli.Commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	err := app.Run()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
+	"quick-terminal/server/service"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AdminApi lets operators inspect the gateway.
+type AdminApi struct{}
+
+// SessionListEndpoint lists the live sessions, filtered by the protocol,
+// mode, target, username, principal and clientIp parameters and sorted by sort,
+// prefixed with "-" for descending order. The filters match like those of
+// SessionKillAllEndpoint, target and clientIp are host patterns.
+func (api AdminApi) SessionListEndpoint(c echo.Context) error {
+	query := service.SessionQuery{
+		SessionFilter: service.SessionFilter{
+			Protocol:  c.QueryParam("protocol"),
+			Target:    c.QueryParam("target"),
+			Username:  c.QueryParam("username"),
+			Principal: c.QueryParam("principal"),
+		},
+		Mode:     c.QueryParam("mode"),
+		ClientIP: c.QueryParam("clientIp"),
+		Sort:     c.QueryParam("sort"),
+	}
+	if len(query.Sort) > 0 && query.Sort[0] == '-' {
+		query.Sort = query.Sort[1:]
+		query.Desc = true
+	}
+	if !service.ValidSessionSort(query.Sort) {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown sort field "+query.Sort)
+	}
+	return Success(c, service.SessionService.List(query))
+}
+
+const defaultKillReason = "Disconnected by an administrator"
+
+// SessionKillEndpoint disconnects a session, the reason parameter is shown
+// to its user.
+func (api AdminApi) SessionKillEndpoint(c echo.Context) error {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	sessionId := c.Param("id")
+	if session.GlobalSessionManager.GetById(sessionId) == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+	reason := c.QueryParam("reason")
+	if reason == "" {
+		reason = defaultKillReason
+	}
+	service.SessionService.CloseSessionById(sessionId, ForcedDisconnect, reason)
+	log.Info("session killed", log.String("sessionId", sessionId), log.String("by", principal.Name), log.String("reason", reason))
+	return Success(c, nil)
+}
+
+// SessionKillAllEndpoint disconnects every session matching a filter, at
+// least one filter field is required.
+func (api AdminApi) SessionKillAllEndpoint(c echo.Context) error {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	var form struct {
+		service.SessionFilter
+		Reason string `json:"reason"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	if form.SessionFilter.Empty() {
+		return echo.NewHTTPError(http.StatusBadRequest, "a filter is required")
+	}
+	if form.Reason == "" {
+		form.Reason = defaultKillReason
+	}
+	killed := make([]string, 0)
+	for _, s := range service.SessionService.Sessions(form.SessionFilter) {
+		service.SessionService.CloseSessionById(s.ID, ForcedDisconnect, form.Reason)
+		killed = append(killed, s.ID)
+	}
+	log.Info("sessions killed", log.Any("sessionIds", killed), log.Any("filter", form.SessionFilter), log.String("by", principal.Name), log.String("reason", form.Reason))
+	return Success(c, echo.Map{"killed": killed})
+}
+
+// NoticeEndpoint shows a notice in the live sessions matching the optional
+// filter, without disconnecting them.
+func (api AdminApi) NoticeEndpoint(c echo.Context) error {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	var form struct {
+		service.SessionFilter
+		Level   string `json:"level"`
+		Message string `json:"message"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	if form.Message == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
+	}
+	switch form.Level {
+	case "":
+		form.Level = "info"
+	case "info", "warning", "error":
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown level "+form.Level)
+	}
+	n := service.SessionService.Broadcast(form.SessionFilter, form.Level, form.Message)
+	log.Info("notice sent", log.String("message", form.Message), log.Int("sessions", n), log.String("by", principal.Name))
+	return Success(c, echo.Map{"sessions": n})
+}
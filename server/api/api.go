@@ -2,6 +2,8 @@ package api
 
 import (
 	"quick-terminal/server/common/maps"
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
 
 	"github.com/labstack/echo/v4"
 )
@@ -28,3 +30,12 @@ func Success(c echo.Context, data interface{}) error {
 		"data":    data,
 	})
 }
+
+// principalName is the name of the principal authenticated by the request,
+// empty for anonymous sessions.
+func principalName(c echo.Context) string {
+	if principal, ok := c.Get(nt.Principal).(*config.AuthToken); ok && principal != nil {
+		return principal.Name
+	}
+	return ""
+}
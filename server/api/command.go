@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+	"quick-terminal/server/repository"
+	"quick-terminal/server/service"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CommandApi struct{}
+
+// CommandSearchEndpoint finds commands in indexed recordings, e.g.
+// ?q=systemctl restart nginx&from=2024-01-01 answers who ran it since then.
+func (api CommandApi) CommandSearchEndpoint(c echo.Context) error {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	from, err := parseQueryTime(c.QueryParam("from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid from: "+err.Error())
+	}
+	to, err := parseQueryTime(c.QueryParam("to"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid to: "+err.Error())
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+	regex, _ := strconv.ParseBool(c.QueryParam("regex"))
+
+	items, err := service.CommandService.Search(principal, repository.CommandQuery{
+		Text:      c.QueryParam("q"),
+		Regex:     regex,
+		SessionId: c.QueryParam("sessionId"),
+		Username:  c.QueryParam("username"),
+		Principal: c.QueryParam("principal"),
+		Target:    c.QueryParam("target"),
+		From:      from,
+		To:        to,
+		Limit:     limit,
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return Success(c, items)
+}
+
+// RecordingCommandsEndpoint lists the commands of one recording.
+func (api CommandApi) RecordingCommandsEndpoint(c echo.Context) error {
+	recording, err := RecordingApi{}.getRecording(c)
+	if err != nil {
+		return err
+	}
+	commands, err := service.CommandService.RecordingCommands(recording)
+	if err != nil {
+		return err
+	}
+	return Success(c, commands)
+}
+
+// parseQueryTime accepts RFC 3339 and the local "2006-01-02 15:04:05" and
+// "2006-01-02" forms, empty is the zero time.
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
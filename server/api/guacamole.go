@@ -2,6 +2,7 @@ package api
 
 import (
 	"errors"
+	"net"
 	"net/http"
 	"path"
 	"quick-terminal/server/common/guacamole"
@@ -9,11 +10,16 @@ import (
 	"quick-terminal/server/model"
 	"quick-terminal/server/utils"
 	"strconv"
+	"time"
 
 	"quick-terminal/server/config"
+	"quick-terminal/server/event"
 	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
+	"quick-terminal/server/metrics"
 	"quick-terminal/server/service"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 )
@@ -28,6 +34,10 @@ const (
 	AccessGatewayCreateError int = 804
 	AssetNotActive           int = 805
 	NewSshClientError        int = 806
+	IdleTimeout              int = 807
+	SessionExpired           int = 808
+	RecordingFailed          int = 809
+	ServerShutdown           int = 810
 )
 
 var UpGrader = websocket.Upgrader{
@@ -72,12 +82,19 @@ func (api GuacamoleApi) Guacamole(c echo.Context) error {
 	}
 	username, _ := payload["username"].(string)
 	password, _ := payload["password"].(string)
+	principal := principalName(c)
 	privateKey := ""
 	passphrase := ""
 
 	creator := ""
 	assetId := ""
 
+	metrics.ConnectionAttempt(protocol, mode)
+
+	requested, _ := payload["recording"].(bool)
+	isRecording, recordingRequired := service.RecordingService.Policy(ip, port, username, requested)
+	recordAtGateway := isRecording && service.RecordingService.RecordsGuacdAtGateway()
+
 	var s model.Session
 	s.ID = id
 	s.Protocol = protocol
@@ -90,14 +107,27 @@ func (api GuacamoleApi) Guacamole(c echo.Context) error {
 	s.Passphrase = passphrase
 	s.Creator = creator
 	s.AssetId = assetId
+	if isRecording {
+		s.Recording = service.RecordingService.NewRecordingDir(sessionId)
+	}
 
 	width := c.QueryParam("width")
 	height := c.QueryParam("height")
+	s.Principal = principal
+	s.ClientIP = c.RealIP()
+	s.Width, _ = strconv.Atoi(width)
+	s.Height, _ = strconv.Atoi(height)
+	history := service.SessionService.NewHistory(s)
+	// Records connections ending without CloseSessionById, a no-op otherwise
+	defer service.SessionService.HistoryDisconnected(history, TunnelClosed, "Connection closed")
 	dpi := c.QueryParam("dpi")
 
 	configuration := guacamole.NewConfiguration()
 
 	propertyMap := map[string]string{}
+	if isRecording && !recordAtGateway {
+		propertyMap[guacamole.EnableRecording] = "true"
+	}
 
 	configuration.SetParameter("width", width)
 	configuration.SetParameter("height", height)
@@ -116,7 +146,6 @@ func (api GuacamoleApi) Guacamole(c echo.Context) error {
 		"enable-font-smoothing":      "true",
 		"enable-full-window-drag":    "true",
 		"enable-menu-animations":     "true",
-		"enable-recording":           "true",
 		"enable-theming":             "true",
 		"enable-wallpaper":           "true",
 		"font-name":                  "menlo",
@@ -135,25 +164,91 @@ func (api GuacamoleApi) Guacamole(c echo.Context) error {
 		}
 	}
 
+	var recorder *guacamole.Recorder
+	recording := s.Recording
+	if recordAtGateway {
+		recorder, err = guacamole.NewRecorder(s.Recording)
+		if err != nil {
+			if recordingRequired {
+				// Fail closed, guacd is never connected without the recording
+				metrics.ConnectionFailure(protocol, mode, RecordingFailed)
+				service.SessionService.HistoryDisconnected(history, RecordingFailed, "Failed to create recording: "+err.Error())
+				guacamole.Disconnect(ws, RecordingFailed, "Failed to create recording: "+err.Error())
+				return err
+			}
+			log.Warn("create recording failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+			recorder = nil
+			recording = ""
+		} else {
+			defer func() {
+				if err := recorder.Close(); err != nil {
+					log.Warn("close recording failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+				}
+				service.RecordingService.Finished(sessionId, history, recording)
+			}()
+			writeRecordingMeta(s.Recording, model.RecordingGuac, sessionId, protocol, ip, port, username, principal)
+		}
+	}
+
+	var keyLogger *guacamole.KeyLogger
+	if isRecording {
+		keyLogger, err = service.RecordingService.NewKeyLogger(s.Recording)
+		if err != nil {
+			log.Warn("create keystroke log failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+			keyLogger = nil
+		} else if keyLogger != nil {
+			defer func() {
+				if err := keyLogger.Close(); err != nil {
+					log.Warn("close keystroke log failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+				}
+			}()
+		}
+	}
+
 	addr := config.GlobalCfg.Guacd.Hostname + ":" + strconv.Itoa(config.GlobalCfg.Guacd.Port)
 
+	handshakeStart := time.Now()
 	guacdTunnel, err := guacamole.NewTunnel(addr, configuration)
 	if err != nil {
+		metrics.ConnectionFailure(protocol, mode, NewTunnelError)
+		service.SessionService.HistoryDisconnected(history, NewTunnelError, err.Error())
 		guacamole.Disconnect(ws, NewTunnelError, err.Error())
 		return err
 	}
+	metrics.GuacdHandshake(handshakeStart)
+	if isRecording && !recordAtGateway {
+		// guacd writes the recording until the tunnel is closed, the keystroke
+		// log is closed first so that it is sealed with the recording
+		defer func() {
+			if keyLogger != nil {
+				_ = keyLogger.Close()
+			}
+			service.RecordingService.Finished(sessionId, history, s.Recording)
+		}()
+	}
 
 	quickSession := &session.Session{
-		ID:          sessionId,
-		Protocol:    s.Protocol,
-		Mode:        s.Mode,
-		WebSocket:   ws,
-		GuacdTunnel: guacdTunnel,
+		ID:            sessionId,
+		Protocol:      s.Protocol,
+		Mode:          s.Mode,
+		WebSocket:     ws,
+		GuacdTunnel:   guacdTunnel,
+		Target:        net.JoinHostPort(ip, strconv.Itoa(port)),
+		Username:      username,
+		Principal:     principal,
+		Hostname:      ip,
+		ClientIP:      c.RealIP(),
+		History:       history,
+		Recording:     s.Recording,
+		KeyLogger:     keyLogger,
+		ConnectedTime: time.Now(),
 	}
 
 	if configuration.Protocol == nt.SSH {
 		quickTerminal, err := CreateQuickTerminalBySession(s)
 		if err != nil {
+			metrics.ConnectionFailure(protocol, mode, NewSshClientError)
+			service.SessionService.HistoryDisconnected(history, NewSshClientError, "Failed to establish SSH Client: "+err.Error())
 			guacamole.Disconnect(ws, NewSshClientError, "Failed to establish SSH Client: "+err.Error())
 			return err
 		}
@@ -162,11 +257,16 @@ func (api GuacamoleApi) Guacamole(c echo.Context) error {
 
 	quickSession.Observer = session.NewObserver(sessionId)
 	session.GlobalSessionManager.Add(quickSession)
+	service.SessionService.HistoryConnected(history, recording)
 
-	guacamoleHandler := NewGuacamoleHandler(ws, guacdTunnel)
+	guacamoleHandler := NewGuacamoleHandler(quickSession)
+	guacamoleHandler.activity = quickSession
+	guacamoleHandler.recorder = recorder
 	guacamoleHandler.Start()
 	defer guacamoleHandler.Stop()
 
+	go WatchSessionTimeout(guacamoleHandler.ctx, sessionId)
+
 	for {
 		_, message, err := ws.ReadMessage()
 		if err != nil {
@@ -175,6 +275,19 @@ func (api GuacamoleApi) Guacamole(c echo.Context) error {
 			service.SessionService.CloseSessionById(sessionId, Normal, "Exited")
 			return nil
 		}
+		quickSession.AddBytesIn(len(message))
+		if cols, rows, ok := guacamoleSize(message); ok {
+			event.Publish(event.New(event.SessionResized, sessionId, history, event.Resized{Cols: cols, Rows: rows}))
+		}
+		if isGuacamoleInput(message) {
+			quickSession.TouchInput()
+		}
+		if keyLogger != nil {
+			// Clipboard content follows in blob instructions
+			if err := keyLogger.Write(message); err != nil {
+				log.Debug("log keystrokes failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+			}
+		}
 		_, err = guacdTunnel.WriteAndFlush(message)
 		if err != nil {
 			service.SessionService.CloseSessionById(sessionId, TunnelClosed, "Remote connection closed")
@@ -183,6 +296,117 @@ func (api GuacamoleApi) Guacamole(c echo.Context) error {
 	}
 }
 
+// GuacamoleMonitorEndpoint joins the guacd connection of a live session, so
+// that an observer is shown its display. Observers are read only, an admin
+// may join with readOnly=false to take part. The input of such an admin
+// counts as input of the session, it is logged tagged with the admin's name
+// and audited when the admin leaves.
+func (api GuacamoleApi) GuacamoleMonitorEndpoint(c echo.Context) error {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	sessionId := c.Param("id")
+	quickSession := session.GlobalSessionManager.GetById(sessionId)
+	if quickSession == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+	if quickSession.GuacdTunnel == nil || quickSession.Observer == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "session can not be monitored")
+	}
+	if !service.SessionService.CanObserve(principal, quickSession) {
+		return echo.NewHTTPError(http.StatusForbidden, nt.ErrPermissionDenied.Error())
+	}
+	readOnly := c.QueryParam("readOnly") != "false"
+	if !readOnly && !principal.HasRole(nt.RoleAdmin) {
+		return echo.NewHTTPError(http.StatusForbidden, nt.ErrPermissionDenied.Error())
+	}
+
+	ws, err := UpGrader.Upgrade(c.Response().Writer, c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ws.Close()
+	}()
+
+	configuration := guacamole.NewConfiguration()
+	configuration.ConnectionID = quickSession.GuacdTunnel.UUID
+	configuration.Protocol = quickSession.Protocol
+	configuration.SetParameter("width", c.QueryParam("width"))
+	configuration.SetParameter("height", c.QueryParam("height"))
+	configuration.SetParameter("dpi", c.QueryParam("dpi"))
+	if readOnly {
+		configuration.SetReadOnlyMode()
+	}
+	addr := config.GlobalCfg.Guacd.Hostname + ":" + strconv.Itoa(config.GlobalCfg.Guacd.Port)
+	guacdTunnel, err := guacamole.NewTunnel(addr, configuration)
+	if err != nil {
+		guacamole.Disconnect(ws, NewTunnelError, err.Error())
+		return nil
+	}
+
+	observer := &session.Session{
+		ID:            uuid.NewString(),
+		Protocol:      quickSession.Protocol,
+		Mode:          quickSession.Mode,
+		WebSocket:     ws,
+		GuacdTunnel:   guacdTunnel,
+		Principal:     principal.Name,
+		ClientIP:      c.RealIP(),
+		ConnectedTime: time.Now(),
+	}
+	quickSession.Observer.Add(observer)
+	defer quickSession.Observer.Del(observer.ID)
+	if session.GlobalSessionManager.GetById(sessionId) == nil {
+		// The session ended while joining
+		service.SessionService.WriteCloseMessage(observer, observer.Mode, NotFoundSession, "Session closed")
+		return nil
+	}
+	log.Info("observer joined", log.String("sessionId", sessionId), log.String("observer", observer.ID), log.String("principal", principal.Name), log.Any("readOnly", readOnly))
+	defer log.Info("observer left", log.String("sessionId", sessionId), log.String("observer", observer.ID))
+	var inputBytes int
+	defer func() {
+		if inputBytes > 0 {
+			log.Info("session input",
+				log.String("sessionId", sessionId),
+				log.String("participant", observer.ID),
+				log.String("name", principal.Name),
+				log.Int("bytes", inputBytes),
+			)
+		}
+	}()
+
+	guacamoleHandler := NewGuacamoleHandler(observer)
+	guacamoleHandler.Start()
+	defer guacamoleHandler.Stop()
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		input := isGuacamoleInput(message)
+		if readOnly && input {
+			// guacd ignores it as well
+			continue
+		}
+		if !readOnly {
+			if input {
+				inputBytes += len(message)
+				quickSession.AddBytesIn(len(message))
+				quickSession.TouchInput()
+			}
+			if quickSession.KeyLogger != nil {
+				// Clipboard content follows in blob instructions
+				if err := quickSession.KeyLogger.WriteAs(principal.Name, message); err != nil {
+					log.Debug("log keystrokes failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+				}
+			}
+		}
+		if _, err := guacdTunnel.WriteAndFlush(message); err != nil {
+			return nil
+		}
+	}
+}
+
 func (api GuacamoleApi) setAssetConfig(attributes map[string]string, s model.Session, configuration *guacamole.Configuration) {
 	for key, value := range attributes {
 		if guacamole.DrivePath == key {
@@ -207,7 +431,8 @@ func (api GuacamoleApi) setAssetConfig(attributes map[string]string, s model.Ses
 
 func (api GuacamoleApi) setConfig(propertyMap map[string]string, s model.Session, configuration *guacamole.Configuration) {
 	if propertyMap[guacamole.EnableRecording] == "true" {
-		configuration.SetParameter(guacamole.RecordingPath, path.Join(config.GlobalCfg.Guacd.Recording, s.ID))
+		configuration.SetParameter(guacamole.RecordingPath, s.Recording)
+		configuration.SetParameter(guacamole.RecordingName, guacamole.RecordingFile)
 		configuration.SetParameter(guacamole.CreateRecordingPath, "true")
 	} else {
 		configuration.SetParameter(guacamole.RecordingPath, "")
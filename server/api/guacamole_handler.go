@@ -1,24 +1,33 @@
 package api
 
 import (
+	"bytes"
 	"context"
-	"quick-terminal/server/common/guacamole"
+	"strconv"
 
-	"github.com/gorilla/websocket"
+	"quick-terminal/server/common/guacamole"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
 )
 
 type GuacamoleHandler struct {
-	ws     *websocket.Conn
+	// sess is written to under its lock, kills, notices and timeouts write
+	// to the same websocket
+	sess   *session.Session
 	tunnel *guacamole.Tunnel
 	ctx    context.Context
 	cancel context.CancelFunc
+	// activity is touched on input and output for the session timeouts
+	activity *session.Session
+	// recorder records the instructions from guacd when recorded at the gateway
+	recorder *guacamole.Recorder
 }
 
-func NewGuacamoleHandler(ws *websocket.Conn, tunnel *guacamole.Tunnel) *GuacamoleHandler {
+func NewGuacamoleHandler(sess *session.Session) *GuacamoleHandler {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &GuacamoleHandler{
-		ws:     ws,
-		tunnel: tunnel,
+		sess:   sess,
+		tunnel: sess.GuacdTunnel,
 		ctx:    ctx,
 		cancel: cancel,
 	}
@@ -33,14 +42,25 @@ func (r GuacamoleHandler) Start() {
 			default:
 				instruction, err := r.tunnel.Read()
 				if err != nil {
-					guacamole.Disconnect(r.ws, TunnelClosed, "Remote connection closed.")
+					r.sess.Disconnect(TunnelClosed, "Remote connection closed.")
 					return
 				}
 				if len(instruction) == 0 {
 					continue
 				}
-				err = r.ws.WriteMessage(websocket.TextMessage, instruction)
-				if err != nil {
+				if r.activity != nil {
+					r.activity.AddBytesOut(len(instruction))
+					if isGuacamoleOutput(instruction) {
+						r.activity.TouchOutput()
+					}
+				}
+				if r.recorder != nil {
+					if _, err := r.recorder.Write(instruction); err != nil {
+						log.Warn("write recording failed", log.String("recording", r.recorder.Dir), log.NamedError("err", err))
+						r.recorder = nil
+					}
+				}
+				if err := r.sess.WriteText(instruction); err != nil {
 					return
 				}
 			}
@@ -51,3 +71,55 @@ func (r GuacamoleHandler) Start() {
 func (r GuacamoleHandler) Stop() {
 	r.cancel()
 }
+
+var (
+	guacamoleSync = []byte("4.sync,")
+	guacamoleNop  = []byte("3.nop;")
+
+	guacamoleInputs = [][]byte{
+		[]byte("3.key,"),
+		[]byte("5.mouse,"),
+		[]byte("5.touch,"),
+		[]byte("9.clipboard,"),
+	}
+)
+
+// isGuacamoleOutput reports whether an instruction from guacd carries display
+// updates, as opposed to the sync and nop keep-alives sent while idle.
+func isGuacamoleOutput(instruction []byte) bool {
+	return !bytes.HasPrefix(instruction, guacamoleSync) && !bytes.HasPrefix(instruction, guacamoleNop)
+}
+
+// isGuacamoleInput reports whether a message from the browser contains user input.
+func isGuacamoleInput(message []byte) bool {
+	for _, opcode := range guacamoleInputs {
+		if bytes.Contains(message, opcode) {
+			return true
+		}
+	}
+	return false
+}
+
+var guacamoleSizeOpcode = []byte("4.size,")
+
+// guacamoleSize returns the size of the display in a size instruction of
+// the client.
+func guacamoleSize(message []byte) (width, height int, ok bool) {
+	if !bytes.Contains(message, guacamoleSizeOpcode) {
+		return 0, 0, false
+	}
+	reader := guacamole.NewInstructionReader(bytes.NewReader(message))
+	for {
+		_, instruction, err := reader.Read()
+		if err != nil {
+			return width, height, ok
+		}
+		if instruction.Opcode == "size" && len(instruction.Args) >= 2 {
+			w, err1 := strconv.Atoi(instruction.Args[0])
+			h, err2 := strconv.Atoi(instruction.Args[1])
+			if err1 == nil && err2 == nil {
+				width, height, ok = w, h, true
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+
+	"quick-terminal/server/common/maps"
+	"quick-terminal/server/service"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HealthApi answers the liveness and readiness probes of orchestrators, so
+// its endpoints answer with plain HTTP status codes.
+type HealthApi struct{}
+
+// LivenessEndpoint reports that the server is serving requests.
+func (api HealthApi) LivenessEndpoint(c echo.Context) error {
+	return c.JSON(http.StatusOK, maps.Map{"status": "ok"})
+}
+
+// ReadinessEndpoint reports whether guacd and the data directories are
+// usable, failing checks answer 503.
+func (api HealthApi) ReadinessEndpoint(c echo.Context) error {
+	checks, ready := service.HealthService.Ready()
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	return c.JSON(code, maps.Map{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// DiagnosticsEndpoint reports the guacd protocol version, the build and the
+// configuration without its secrets.
+func (api HealthApi) DiagnosticsEndpoint(c echo.Context) error {
+	return Success(c, service.HealthService.Diagnostics())
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"quick-terminal/server/common/maps"
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+	"quick-terminal/server/repository"
+	"quick-terminal/server/service"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const maxHistoryPageSize = 1000
+
+// HistoryApi queries the session history, the stored record of every
+// connection with its close code and reason.
+type HistoryApi struct{}
+
+// HistoryListEndpoint returns a page of the history, newest first, selected
+// by pageIndex and pageSize and filtered by the sessionId, protocol, status,
+// ip, username, principal, from and to parameters.
+func (api HistoryApi) HistoryListEndpoint(c echo.Context) error {
+	if repository.DB == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "session history is disabled")
+	}
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	pageIndex, _ := strconv.Atoi(c.QueryParam("pageIndex"))
+	if pageIndex <= 0 {
+		pageIndex = 1
+	}
+	pageSize, _ := strconv.Atoi(c.QueryParam("pageSize"))
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	if pageSize > maxHistoryPageSize {
+		pageSize = maxHistoryPageSize
+	}
+	from, err := parseQueryTime(c.QueryParam("from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid from: "+err.Error())
+	}
+	to, err := parseQueryTime(c.QueryParam("to"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid to: "+err.Error())
+	}
+
+	items, total, err := service.SessionService.History(principal, repository.SessionQuery{
+		SessionId: c.QueryParam("sessionId"),
+		Protocol:  c.QueryParam("protocol"),
+		Status:    c.QueryParam("status"),
+		IP:        c.QueryParam("ip"),
+		Username:  c.QueryParam("username"),
+		Principal: c.QueryParam("principal"),
+		From:      from,
+		To:        to,
+		PageIndex: pageIndex,
+		PageSize:  pageSize,
+	})
+	if err != nil {
+		return err
+	}
+	return Success(c, maps.Map{
+		"total": total,
+		"items": items,
+	})
+}
+
+func (api HistoryApi) HistoryGetEndpoint(c echo.Context) error {
+	if repository.DB == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "session history is disabled")
+	}
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	record, err := service.SessionService.HistoryById(principal, c.Param("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return echo.NewHTTPError(http.StatusForbidden, nt.ErrPermissionDenied.Error())
+	}
+	return Success(c, record)
+}
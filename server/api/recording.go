@@ -0,0 +1,181 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+	"quick-terminal/server/log"
+	"quick-terminal/server/model"
+	"quick-terminal/server/service"
+
+	"github.com/labstack/echo/v4"
+)
+
+type RecordingApi struct{}
+
+func (api RecordingApi) RecordingListEndpoint(c echo.Context) error {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	sessionId := c.QueryParam("sessionId")
+	target := c.QueryParam("target")
+	protocol := c.QueryParam("protocol")
+
+	recordings, err := service.RecordingService.List()
+	if err != nil {
+		return err
+	}
+	items := make([]model.Recording, 0)
+	for i := range recordings {
+		recording := &recordings[i]
+		if !service.RecordingService.CanView(principal, recording) {
+			continue
+		}
+		if sessionId != "" && recording.SessionId != sessionId {
+			continue
+		}
+		if target != "" && !strings.Contains(recording.Target, target) {
+			continue
+		}
+		if protocol != "" && recording.Protocol != protocol {
+			continue
+		}
+		items = append(items, *recording)
+	}
+	return Success(c, items)
+}
+
+func (api RecordingApi) RecordingGetEndpoint(c echo.Context) error {
+	recording, err := api.getRecording(c)
+	if err != nil {
+		return err
+	}
+	return Success(c, recording)
+}
+
+func (api RecordingApi) RecordingDownloadEndpoint(c echo.Context) error {
+	recording, err := api.getRecording(c)
+	if err != nil {
+		return err
+	}
+	filename := recording.ID + path.Ext(recording.Path)
+	if recording.Segments > 0 {
+		filename = recording.ID + ".cast"
+	} else if recording.Format == model.RecordingGuac && path.Ext(recording.Path) == "" {
+		filename += ".guac"
+	}
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Response().Header().Set("Content-Type", "application/octet-stream")
+	if recording.Segments == 0 {
+		http.ServeFile(c.Response(), c.Request(), recording.Path)
+		return nil
+	}
+	// Segments are joined on the fly, so there is no length or range support
+	reader, err := service.RecordingService.Open(recording)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = io.Copy(c.Response(), reader)
+	return err
+}
+
+// RecordingStreamEndpoint streams a recording for a web player, from and to
+// select a window in seconds.
+func (api RecordingApi) RecordingStreamEndpoint(c echo.Context) error {
+	recording, err := api.getRecording(c)
+	if err != nil {
+		return err
+	}
+	from, _ := strconv.ParseFloat(c.QueryParam("from"), 64)
+	to, _ := strconv.ParseFloat(c.QueryParam("to"), 64)
+
+	resp := c.Response()
+	switch recording.Format {
+	case model.RecordingAsciicast:
+		resp.Header().Set(echo.HeaderContentType, "application/x-asciicast")
+		resp.WriteHeader(http.StatusOK)
+		return service.RecordingService.StreamAsciicast(resp, resp.Flush, recording, from, to)
+	default:
+		resp.Header().Set(echo.HeaderContentType, "application/octet-stream")
+		resp.WriteHeader(http.StatusOK)
+		return service.RecordingService.StreamGuac(resp, resp.Flush, recording, from, to)
+	}
+}
+
+// RecordingVerifyEndpoint reports whether a recording was modified after it
+// was written.
+func (api RecordingApi) RecordingVerifyEndpoint(c echo.Context) error {
+	recording, err := api.getRecording(c)
+	if err != nil {
+		return err
+	}
+	verification, err := service.RecordingService.Verify(recording)
+	if err != nil {
+		return Fail(c, -1, err.Error())
+	}
+	return Success(c, verification)
+}
+
+// RecordingExportEndpoint converts an asciicast recording for viewing without
+// a player, format is "text" (default) or "html".
+func (api RecordingApi) RecordingExportEndpoint(c echo.Context) error {
+	recording, err := api.getRecording(c)
+	if err != nil {
+		return err
+	}
+	if recording.Format != model.RecordingAsciicast {
+		return echo.NewHTTPError(http.StatusBadRequest, service.ErrRecordingNotExportable.Error())
+	}
+	format := c.QueryParam("format")
+	resp := c.Response()
+	switch format {
+	case "html":
+		resp.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+		resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.html", recording.ID))
+	case "", "text":
+		format = "text"
+		resp.Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+		resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.txt", recording.ID))
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown format "+format)
+	}
+	resp.WriteHeader(http.StatusOK)
+	if err := service.RecordingService.Export(resp, recording, format); err != nil {
+		// The response has started, all that is left is to log the failure
+		log.Warn("export recording failed", log.String("recording", recording.ID), log.NamedError("err", err))
+	}
+	return nil
+}
+
+// RecordingKeysEndpoint returns the keystroke log of a guacd recording.
+func (api RecordingApi) RecordingKeysEndpoint(c echo.Context) error {
+	recording, err := api.getRecording(c)
+	if err != nil {
+		return err
+	}
+	file, err := service.RecordingService.KeyLogPath(recording)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+	http.ServeFile(c.Response(), c.Request(), file)
+	return nil
+}
+
+func (api RecordingApi) getRecording(c echo.Context) (*model.Recording, error) {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	recording, err := service.RecordingService.GetById(c.Param("id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if !service.RecordingService.CanView(principal, recording) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, nt.ErrPermissionDenied.Error())
+	}
+	return recording, nil
+}
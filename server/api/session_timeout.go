@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"quick-terminal/server/config"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/service"
+)
+
+type sessionLimit struct {
+	code     int
+	reason   string
+	deadline time.Time
+}
+
+// WatchSessionTimeout disconnects the session once it has been idle or
+// connected for longer than configured, warning the user ahead of time.
+// It returns when ctx is done or the session is gone.
+func WatchSessionTimeout(ctx context.Context, sessionId string) {
+	cfg := config.GlobalCfg.Session
+	if cfg == nil || (cfg.IdleInputTimeout <= 0 && cfg.IdleOutputTimeout <= 0 && cfg.MaxDuration <= 0) {
+		return
+	}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	var warned time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			quickSession := session.GlobalSessionManager.GetById(sessionId)
+			if quickSession == nil {
+				return
+			}
+			limit := nextSessionLimit(quickSession, cfg)
+			if limit == nil {
+				continue
+			}
+			if !now.Before(limit.deadline) {
+				service.SessionService.CloseSessionById(sessionId, limit.code, limit.reason)
+				return
+			}
+			if cfg.TimeoutWarning > 0 && limit.deadline.Sub(now) <= cfg.TimeoutWarning && !warned.Equal(limit.deadline) {
+				warned = limit.deadline
+				seconds := int(limit.deadline.Sub(now).Round(time.Second).Seconds())
+				notice := fmt.Sprintf("Session will be disconnected in %d seconds: %s.", seconds, limit.reason)
+				service.SessionService.WriteNoticeMessage(quickSession, quickSession.Mode, "warning", notice)
+			}
+		}
+	}
+}
+
+func nextSessionLimit(s *session.Session, cfg *config.Session) *sessionLimit {
+	var next *sessionLimit
+	consider := func(timeout time.Duration, from time.Time, code int, reason string) {
+		if timeout <= 0 {
+			return
+		}
+		deadline := from.Add(timeout)
+		if next == nil || deadline.Before(next.deadline) {
+			next = &sessionLimit{code: code, reason: reason, deadline: deadline}
+		}
+	}
+	consider(cfg.MaxDuration, s.ConnectedTime, SessionExpired, "maximum session duration reached")
+	consider(cfg.IdleInputTimeout, s.LastInput(), IdleTimeout, "no user input")
+	consider(cfg.IdleOutputTimeout, s.LastOutput(), IdleTimeout, "no output from the remote host")
+	return next
+}
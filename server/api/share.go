@@ -0,0 +1,277 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+	"quick-terminal/server/dto"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
+	"quick-terminal/server/service"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Control message actions, clients send them as the content of control
+// messages. The server answers with the state of the session, the input
+// mode as content and the participant in control.
+const (
+	ControlRequest = "request"
+	ControlGrant   = "grant"
+	ControlRelease = "release"
+	ControlDeny    = "deny"
+)
+
+// ShareApi lets the owner of a terminal session share it with participants
+// who may type into it, subject to the input mode of the session. Shares are
+// managed by the principal who opened the session and by admins.
+type ShareApi struct{}
+
+type shareLink struct {
+	session.Share
+	Url string `json:"url"`
+}
+
+func newShareLink(sessionId string, share session.Share) shareLink {
+	return shareLink{Share: share, Url: fmt.Sprintf("/quick/%s/join?share=%s", sessionId, share.Token)}
+}
+
+func (api ShareApi) ShareCreateEndpoint(c echo.Context) error {
+	quickSession, err := api.getSession(c)
+	if err != nil {
+		return err
+	}
+	var form struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	if form.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	share := quickSession.Control.AddShare(form.Name)
+	log.Info("session shared", log.String("sessionId", quickSession.ID), log.String("share", share.Name))
+	return Success(c, newShareLink(quickSession.ID, *share))
+}
+
+func (api ShareApi) ShareListEndpoint(c echo.Context) error {
+	quickSession, err := api.getSession(c)
+	if err != nil {
+		return err
+	}
+	links := make([]shareLink, 0)
+	for _, share := range quickSession.Control.Shares() {
+		links = append(links, newShareLink(quickSession.ID, share))
+	}
+	return Success(c, echo.Map{
+		"mode":   quickSession.Control.Mode(),
+		"holder": quickSession.Control.Holder(),
+		"shares": links,
+	})
+}
+
+// ShareRevokeEndpoint revokes a share and disconnects its participants.
+func (api ShareApi) ShareRevokeEndpoint(c echo.Context) error {
+	quickSession, err := api.getSession(c)
+	if err != nil {
+		return err
+	}
+	token := c.Param("token")
+	if !quickSession.Control.RemoveShare(token) {
+		return echo.NewHTTPError(http.StatusNotFound, "share not found")
+	}
+	released := false
+	quickSession.Observer.Range(func(key string, ob *session.Session) {
+		if ob.Share != token {
+			return
+		}
+		service.SessionService.WriteCloseMessage(ob, ob.Mode, ForcedDisconnect, "Share revoked")
+		quickSession.Observer.Del(key)
+		released = quickSession.Control.Release(key) || released
+	})
+	if released {
+		sendControlState(quickSession)
+	}
+	log.Info("session share revoked", log.String("sessionId", quickSession.ID), log.String("token", token))
+	return Success(c, nil)
+}
+
+// ShareModeEndpoint changes the input mode, control returns to the owner.
+func (api ShareApi) ShareModeEndpoint(c echo.Context) error {
+	quickSession, err := api.getSession(c)
+	if err != nil {
+		return err
+	}
+	var form struct {
+		Mode string `json:"mode"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	if err := quickSession.Control.SetMode(form.Mode); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	sendControlState(quickSession)
+	log.Info("session input mode changed", log.String("sessionId", quickSession.ID), log.String("mode", form.Mode))
+	return Success(c, nil)
+}
+
+// ShareJoinEndpoint lets a participant with a share link join a session.
+// Like an observer the participant is shown the current screen first, its
+// input reaches the session when the input mode allows it. The participant
+// is known by the name the owner gave the share.
+func (api ShareApi) ShareJoinEndpoint(c echo.Context) error {
+	quickSession, err := api.session(c)
+	if err != nil {
+		return err
+	}
+	share := quickSession.Control.Share(c.QueryParam("share"))
+	if share == nil {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid share")
+	}
+	name := share.Name
+
+	ws, err := TermUpGrader.Upgrade(c.Response().Writer, c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ws.Close()
+	}()
+
+	participant := &session.Session{
+		ID:            uuid.NewString(),
+		Protocol:      quickSession.Protocol,
+		Mode:          quickSession.Mode,
+		WebSocket:     ws,
+		Codec:         dto.NewCodec(ws.Subprotocol()),
+		Principal:     name,
+		Share:         share.Token,
+		ClientIP:      c.RealIP(),
+		ConnectedTime: time.Now(),
+	}
+	// Queued, the shadow stays locked only until the observer is added
+	participant.Observe()
+	quickSession.Shadow.Join(func(cols, rows int, snapshot string) {
+		participant.Send(dto.NewMessage(Connected, ""))
+		participant.Send(dto.Message{Type: Resize, Cols: cols, Rows: rows})
+		participant.Send(dto.NewMessage(Data, snapshot))
+		quickSession.Observer.Add(participant)
+	})
+	defer func() {
+		quickSession.Observer.Del(participant.ID)
+		if quickSession.Control.Release(participant.ID) {
+			sendControlState(quickSession)
+		}
+		service.SessionService.WriteNoticeMessage(quickSession, quickSession.Mode, "info", name+" left")
+		log.Info("participant left", log.String("sessionId", quickSession.ID), log.String("participant", participant.ID))
+	}()
+	if session.GlobalSessionManager.GetById(quickSession.ID) == nil || quickSession.Control.Share(share.Token) == nil {
+		// The session ended or the share was revoked while joining
+		service.SessionService.WriteCloseMessage(participant, participant.Mode, NotFoundSession, "Session closed")
+		return nil
+	}
+	log.Info("participant joined", log.String("sessionId", quickSession.ID), log.String("participant", participant.ID), log.String("name", name))
+	service.SessionService.WriteNoticeMessage(quickSession, quickSession.Mode, "info", name+" joined")
+	participant.Send(controlState(quickSession))
+
+	for {
+		messageType, message, err := ws.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		msg, err := participant.Codec.Decode(messageType, message)
+		if err != nil {
+			continue
+		}
+		switch msg.Type {
+		case Data:
+			if quickSession.WriteInput != nil {
+				_ = quickSession.WriteInput(participant.ID, []byte(msg.Content))
+			}
+		case dto.Control:
+			switch msg.Content {
+			case ControlRequest:
+				if quickSession.Control.Mode() == session.InputRequestControl {
+					_ = quickSession.WriteMessage(dto.Message{Type: dto.Control, Content: ControlRequest, Participant: participant.ID})
+					service.SessionService.WriteNoticeMessage(quickSession, quickSession.Mode, "info", name+" requests control")
+				}
+			case ControlRelease:
+				if quickSession.Control.Release(participant.ID) {
+					sendControlState(quickSession)
+				}
+			}
+		case Ping:
+			participant.Send(dto.NewMessage(Ping, ""))
+		}
+	}
+}
+
+// handleOwnerControl applies a control message of the owner of a session.
+func handleOwnerControl(quickSession *session.Session, msg dto.Message) {
+	control := quickSession.Control
+	switch msg.Content {
+	case ControlGrant:
+		participant := quickSession.Observer.GetById(msg.Participant)
+		if participant == nil || participant.Share == "" || !control.Grant(participant.ID) {
+			return
+		}
+		log.Info("session control granted", log.String("sessionId", quickSession.ID), log.String("participant", participant.ID), log.String("name", participant.Principal))
+		sendControlState(quickSession)
+	case ControlRelease:
+		if control.Release(control.Holder()) {
+			sendControlState(quickSession)
+		}
+	case ControlDeny:
+		if participant := quickSession.Observer.GetById(msg.Participant); participant != nil && participant.Share != "" {
+			participant.Send(dto.Message{Type: dto.Control, Content: ControlDeny, Participant: participant.ID})
+		}
+	}
+}
+
+func controlState(quickSession *session.Session) dto.Message {
+	return dto.Message{Type: dto.Control, Content: quickSession.Control.Mode(), Participant: quickSession.Control.Holder()}
+}
+
+// sendControlState tells the owner and the participants of a session the
+// input mode and who is in control.
+func sendControlState(quickSession *session.Session) {
+	msg := controlState(quickSession)
+	_ = quickSession.WriteMessage(msg)
+	quickSession.Observer.Range(func(key string, ob *session.Session) {
+		if ob.Share != "" {
+			ob.Send(msg)
+		}
+	})
+}
+
+// getSession returns the shared session if the authenticated principal owns
+// it or is an admin.
+func (api ShareApi) getSession(c echo.Context) (*session.Session, error) {
+	quickSession, err := api.session(c)
+	if err != nil {
+		return nil, err
+	}
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	if principal == nil || !(principal.HasRole(nt.RoleAdmin) ||
+		(quickSession.Principal != "" && quickSession.Principal == principal.Name)) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, nt.ErrPermissionDenied.Error())
+	}
+	return quickSession, nil
+}
+
+func (api ShareApi) session(c echo.Context) (*session.Session, error) {
+	quickSession := session.GlobalSessionManager.GetById(c.Param("id"))
+	if quickSession == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+	if quickSession.Control == nil || quickSession.Shadow == nil || quickSession.Observer == nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "session can not be shared")
+	}
+	return quickSession, nil
+}
@@ -1,39 +1,61 @@
 package api
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"errors"
+	"net"
+	"net/http"
 	"path"
+	"quick-terminal/server/common"
 	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
 	"quick-terminal/server/utils"
 	"strconv"
+	"time"
 
 	"quick-terminal/server/common/term"
-	"quick-terminal/server/config"
 	"quick-terminal/server/dto"
 	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
+	"quick-terminal/server/metrics"
 	"quick-terminal/server/model"
 	"quick-terminal/server/service"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 )
 
 const (
-	Closed    = 0
-	Connected = 1
-	Data      = 2
-	Resize    = 3
-	Ping      = 4
+	Closed      = dto.Closed
+	Connected   = dto.Connected
+	Data        = dto.Data
+	Resize      = dto.Resize
+	Ping        = dto.Ping
+	ZmodemStart = dto.ZmodemStart
+	ZmodemEnd   = dto.ZmodemEnd
+	Ack         = dto.Ack
+	Notice      = dto.Notice
+	Transfer    = dto.Transfer
 )
 
+var TermUpGrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+	Subprotocols: dto.Subprotocols,
+}
+
 type WebTerminalApi struct {
 }
 
 func WriteMessage(ws *websocket.Conn, msg dto.Message) error {
-	message := []byte(msg.ToString())
-	return ws.WriteMessage(websocket.TextMessage, message)
+	messageType, message, err := dto.NewCodec(ws.Subprotocol()).Encode(msg)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(messageType, message)
 }
 
 func CreateQuickTerminalBySession(session model.Session) (*term.QuickTerminal, error) {
@@ -49,7 +71,7 @@ func CreateQuickTerminalBySession(session model.Session) (*term.QuickTerminal, e
 }
 
 func (api WebTerminalApi) SshEndpoint(c echo.Context) error {
-	ws, err := UpGrader.Upgrade(c.Response().Writer, c.Request(), nil)
+	ws, err := TermUpGrader.Upgrade(c.Response().Writer, c.Request(), nil)
 	if err != nil {
 		return err
 	}
@@ -82,6 +104,7 @@ func (api WebTerminalApi) SshEndpoint(c echo.Context) error {
 	}
 	username, _ := payload["username"].(string)
 	password, _ := payload["password"].(string)
+	principal := principalName(c)
 	privateKey := ""
 	passphrase := ""
 
@@ -90,13 +113,25 @@ func (api WebTerminalApi) SshEndpoint(c echo.Context) error {
 
 	cols, _ := strconv.Atoi(c.QueryParam("cols"))
 	rows, _ := strconv.Atoi(c.QueryParam("rows"))
+	cols, rows = dto.ClampWindowSize(cols, rows)
+	metrics.ConnectionAttempt(protocol, mode)
+	history := service.SessionService.NewHistory(model.Session{
+		ID:        sessionId,
+		Protocol:  protocol,
+		Mode:      mode,
+		IP:        ip,
+		Port:      port,
+		Username:  username,
+		Principal: principal,
+		ClientIP:  c.RealIP(),
+		Width:     cols,
+		Height:    rows,
+	})
+	// Records connections ending without CloseSessionById, a no-op otherwise
+	defer service.SessionService.HistoryDisconnected(history, TunnelClosed, "Connection closed")
 
-	recording := ""
-	var isRecording = false
-
-	if isRecording {
-		recording = path.Join(config.GlobalCfg.Guacd.Recording, sessionId, "recording.cast")
-	}
+	requested, _ := payload["recording"].(bool)
+	isRecording, recordingRequired := service.RecordingService.Policy(ip, port, username, requested)
 
 	var attributes = map[string]string{
 		"color-scheme": "gray-black",
@@ -106,15 +141,55 @@ func (api WebTerminalApi) SshEndpoint(c echo.Context) error {
 
 	var xterm = "xterm-256color"
 	var quickTerminal *term.QuickTerminal
+	handshakeStart := time.Now()
 	if attributes[nt.SocksProxyEnable] == "true" {
-		quickTerminal, err = term.NewQuickTerminalUseSocks(ip, port, username, password, privateKey, passphrase, rows, cols, recording, xterm, true, attributes[nt.SocksProxyHost], attributes[nt.SocksProxyPort], attributes[nt.SocksProxyUsername], attributes[nt.SocksProxyPassword])
+		quickTerminal, err = term.NewQuickTerminalUseSocks(ip, port, username, password, privateKey, passphrase, rows, cols, "", xterm, true, attributes[nt.SocksProxyHost], attributes[nt.SocksProxyPort], attributes[nt.SocksProxyUsername], attributes[nt.SocksProxyPassword])
 	} else {
-		quickTerminal, err = term.NewQuickTerminal(ip, port, username, password, privateKey, passphrase, rows, cols, recording, xterm, true)
+		quickTerminal, err = term.NewQuickTerminal(ip, port, username, password, privateKey, passphrase, rows, cols, "", xterm, true)
 	}
 
 	if err != nil {
+		metrics.ConnectionFailure(protocol, mode, NewSshClientError)
+		service.SessionService.HistoryDisconnected(history, NewSshClientError, "Failed to create SSH client: "+err.Error())
 		return WriteMessage(ws, dto.NewMessage(Closed, "Failed to create SSH client: "+err.Error()+"."))
 	}
+	metrics.SshHandshake(handshakeStart)
+
+	var recording string
+	if isRecording {
+		recording = service.RecordingService.NewRecordingDir(sessionId)
+		quickTerminal.Recorder, err = term.NewRecorderWithHeader(recording, &term.Header{
+			Title:  quickTerminal.SshClient.User() + "@" + net.JoinHostPort(ip, strconv.Itoa(port)),
+			Height: rows,
+			Width:  cols,
+			Env:    term.Env{Shell: term.DefaultShell, Term: xterm},
+		}, service.RecordingService.RecorderOptions())
+		if err == nil {
+			if err = recordInput(quickTerminal.Recorder); err != nil {
+				_ = quickTerminal.Recorder.Close()
+			}
+		}
+		if err != nil {
+			if recordingRequired {
+				// Fail closed, the shell is never started without its recording
+				quickTerminal.Close()
+				metrics.ConnectionFailure(protocol, mode, RecordingFailed)
+				service.SessionService.HistoryDisconnected(history, RecordingFailed, "Failed to create recording: "+err.Error())
+				return WriteMessage(ws, dto.NewMessage(Closed, "Failed to create recording: "+err.Error()+"."))
+			}
+			log.Warn("create recording failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+			quickTerminal.Recorder = nil
+			isRecording = false
+			recording = ""
+		} else {
+			writeRecordingMeta(recording, model.RecordingAsciicast, sessionId, protocol, ip, port, username, principal)
+			recorder := quickTerminal.Recorder
+			defer func() {
+				_ = recorder.Close()
+				service.RecordingService.Finished(sessionId, history, recording)
+			}()
+		}
+	}
 
 	if err := quickTerminal.RequestPty(xterm, rows, cols); err != nil {
 		return err
@@ -133,57 +208,308 @@ func (api WebTerminalApi) SshEndpoint(c echo.Context) error {
 		Protocol:      protocol,
 		Mode:          mode,
 		WebSocket:     ws,
+		Codec:         dto.NewCodec(ws.Subprotocol()),
 		GuacdTunnel:   nil,
 		QuickTerminal: quickTerminal,
 		Observer:      session.NewObserver(id),
+		Channels:      session.NewChannels(id),
+		Shadow:        term.NewShadow(cols, rows, term.DefaultShadowScrollback),
+		Control:       session.NewControl(),
+		Target:        net.JoinHostPort(ip, strconv.Itoa(port)),
+		Username:      username,
+		Principal:     principal,
+		Hostname:      ip,
+		ClientIP:      c.RealIP(),
+		History:       history,
+		Recording:     recording,
+		ConnectedTime: time.Now(),
 	}
 	session.GlobalSessionManager.Add(quickSession)
+	service.SessionService.HistoryConnected(history, recording)
 
 	termHandler := NewTermHandler(creator, assetId, sessionId, isRecording, ws, quickTerminal)
+	termHandler.activity = quickSession
+	termHandler.conn = quickSession
+	termHandler.zmodemCapable = zmodemCapable(c, termHandler.codec)
+	termHandler.control = quickSession.Control
+	quickSession.WriteInput = termHandler.WriteAs
+	termHandler.Start()
+	defer termHandler.Stop()
+
+	go WatchSessionTimeout(termHandler.ctx, sessionId)
+
+	api.readMessages(ws, termHandler, func(code int, reason string) {
+		service.SessionService.CloseSessionById(sessionId, code, reason)
+	})
+	return err
+}
+
+// SshChannelEndpoint attaches a new websocket to an additional shell channel
+// of an existing native session, so another tab skips the login. Only the
+// principal who opened the session and admins may open channels.
+func (api WebTerminalApi) SshChannelEndpoint(c echo.Context) error {
+	ws, err := TermUpGrader.Upgrade(c.Response().Writer, c.Request(), nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = ws.Close()
+	}()
+
+	sessionId := c.Param("id")
+	quickSession := session.GlobalSessionManager.GetById(sessionId)
+	if quickSession == nil || quickSession.QuickTerminal == nil || quickSession.Mode != nt.Native {
+		return WriteMessage(ws, dto.NewMessage(Closed, "Session not found."))
+	}
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	if principalName(c) != quickSession.Principal && (principal == nil || !principal.HasRole(nt.RoleAdmin)) {
+		return WriteMessage(ws, dto.NewMessage(Closed, "Permission denied."))
+	}
+	channelId := sessionId + "-" + uuid.NewString()
+
+	cols, _ := strconv.Atoi(c.QueryParam("cols"))
+	rows, _ := strconv.Atoi(c.QueryParam("rows"))
+	cols, rows = dto.ClampWindowSize(cols, rows)
+
+	var xterm = "xterm-256color"
+	// Channels of a recorded connection are recorded as well
+	recording := ""
+	parentRecorder := quickSession.QuickTerminal.Recorder
+	isRecording := parentRecorder != nil
+	if isRecording {
+		recording = service.RecordingService.NewRecordingDir(channelId)
+	}
+	quickTerminal, err := quickSession.QuickTerminal.OpenChannel(recording, xterm, rows, cols)
+	if err != nil {
+		return WriteMessage(ws, dto.NewMessage(Closed, "Failed to open SSH channel: "+err.Error()+"."))
+	}
+	if isRecording {
+		if err := recordInput(quickTerminal.Recorder); err != nil {
+			_ = quickTerminal.Recorder.Close()
+			if channelRecordingRequired(quickSession) {
+				quickTerminal.Close()
+				metrics.ConnectionFailure(quickSession.Protocol, quickSession.Mode, RecordingFailed)
+				return WriteMessage(ws, dto.NewMessage(Closed, "Failed to create recording: "+err.Error()+"."))
+			}
+			log.Warn("create recording failed", log.String("sessionId", channelId), log.NamedError("err", err))
+			quickTerminal.Recorder = nil
+			isRecording = false
+			recording = ""
+		}
+	}
+	if isRecording {
+		if meta, err := service.RecordingService.GetById(path.Base(parentRecorder.Dir)); err == nil {
+			writeRecordingMeta(recording, model.RecordingAsciicast, sessionId, meta.Protocol, meta.Target, 0, meta.Username, meta.Principal)
+		}
+		recorder := quickTerminal.Recorder
+		defer func() {
+			_ = recorder.Close()
+			service.RecordingService.Finished(sessionId, quickSession.History, recording)
+		}()
+	}
+
+	if err := quickTerminal.RequestPty(xterm, rows, cols); err != nil {
+		quickTerminal.Close()
+		return err
+	}
+
+	if err := quickTerminal.Shell(); err != nil {
+		quickTerminal.Close()
+		return err
+	}
+
+	if err := WriteMessage(ws, dto.NewMessage(Connected, "")); err != nil {
+		quickTerminal.Close()
+		return err
+	}
+
+	channelSession := &session.Session{
+		ID:            channelId,
+		Protocol:      quickSession.Protocol,
+		Mode:          quickSession.Mode,
+		WebSocket:     ws,
+		Codec:         dto.NewCodec(ws.Subprotocol()),
+		QuickTerminal: quickTerminal,
+		Recording:     recording,
+	}
+	quickSession.Channels.Add(channelSession)
+
+	termHandler := NewTermHandler("", "", channelId, isRecording, ws, quickTerminal)
+	// Channels count towards the idle timeouts of their connection
+	termHandler.activity = quickSession
+	termHandler.conn = channelSession
+	termHandler.zmodemCapable = zmodemCapable(c, termHandler.codec)
 	termHandler.Start()
 	defer termHandler.Stop()
 
+	api.readMessages(ws, termHandler, func(code int, reason string) {
+		service.SessionService.CloseChannelById(sessionId, channelId, code, reason)
+	})
+	return nil
+}
+
+// zmodemCapable reports whether a client relays ZMODEM transfers as binary
+// frames, v2 clients do, v1 clients ask for it with zmodem=true.
+func zmodemCapable(c echo.Context, codec dto.Codec) bool {
+	return codec.Subprotocol() != "" || c.QueryParam("zmodem") == "true"
+}
+
+func writeRecordingMeta(recording, format, sessionId, protocol, ip string, port int, username, principal string) {
+	target := ip
+	if port > 0 {
+		target = net.JoinHostPort(ip, strconv.Itoa(port))
+	}
+	err := service.RecordingService.WriteMeta(recording, model.Recording{
+		SessionId: sessionId,
+		Protocol:  protocol,
+		Target:    target,
+		Username:  username,
+		Principal: principal,
+		Format:    format,
+		StartTime: common.NowJsonTime(),
+	})
+	if err != nil {
+		log.Warn("write recording meta failed", log.String("sessionId", sessionId), log.NamedError("err", err))
+	}
+}
+
+// recordInput enables input events on recorder when configured.
+// channelRecordingRequired reports whether the channels of a recorded
+// session must be refused when their recording cannot be created.
+func channelRecordingRequired(quickSession *session.Session) bool {
+	host, p, err := net.SplitHostPort(quickSession.Target)
+	if err != nil {
+		return true
+	}
+	port, _ := strconv.Atoi(p)
+	_, required := service.RecordingService.Policy(host, port, quickSession.Username, true)
+	return required
+}
+
+func recordInput(recorder *term.Recorder) error {
+	redactor, err := service.RecordingService.NewRedactor()
+	if err != nil {
+		return err
+	}
+	if redactor != nil {
+		recorder.RecordInput(redactor)
+	}
+	return nil
+}
+
+// SshMonitorEndpoint lets an observer watch a terminal session without
+// being able to type into it. The observer is shown the current screen and
+// scrollback first, then the output as it arrives.
+func (api WebTerminalApi) SshMonitorEndpoint(c echo.Context) error {
+	principal, _ := c.Get(nt.Principal).(*config.AuthToken)
+	sessionId := c.Param("id")
+	quickSession := session.GlobalSessionManager.GetById(sessionId)
+	if quickSession == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+	if quickSession.Shadow == nil || quickSession.Observer == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "session can not be monitored")
+	}
+	if !service.SessionService.CanObserve(principal, quickSession) {
+		return echo.NewHTTPError(http.StatusForbidden, nt.ErrPermissionDenied.Error())
+	}
+
+	ws, err := TermUpGrader.Upgrade(c.Response().Writer, c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ws.Close()
+	}()
+
+	observer := &session.Session{
+		ID:            uuid.NewString(),
+		Protocol:      quickSession.Protocol,
+		Mode:          quickSession.Mode,
+		WebSocket:     ws,
+		Codec:         dto.NewCodec(ws.Subprotocol()),
+		Principal:     principal.Name,
+		ClientIP:      c.RealIP(),
+		ConnectedTime: time.Now(),
+	}
+	// Queued, the shadow stays locked only until the observer is added
+	observer.Observe()
+	quickSession.Shadow.Join(func(cols, rows int, snapshot string) {
+		observer.Send(dto.NewMessage(Connected, ""))
+		observer.Send(dto.Message{Type: Resize, Cols: cols, Rows: rows})
+		observer.Send(dto.NewMessage(Data, snapshot))
+		quickSession.Observer.Add(observer)
+	})
+	defer quickSession.Observer.Del(observer.ID)
+	if session.GlobalSessionManager.GetById(sessionId) == nil {
+		// The session ended while joining
+		service.SessionService.WriteCloseMessage(observer, observer.Mode, NotFoundSession, "Session closed")
+		return nil
+	}
+	log.Info("observer joined", log.String("sessionId", sessionId), log.String("observer", observer.ID), log.String("principal", principal.Name))
+	defer log.Info("observer left", log.String("sessionId", sessionId), log.String("observer", observer.ID))
+
+	// Observers are read only, everything but keep-alives is ignored
+	for {
+		messageType, message, err := ws.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		msg, err := observer.Codec.Decode(messageType, message)
+		if err == nil && msg.Type == Ping {
+			observer.Send(dto.NewMessage(Ping, ""))
+		}
+	}
+}
+
+func (api WebTerminalApi) readMessages(ws *websocket.Conn, termHandler *TermHandler, closeSession func(code int, reason string)) {
+	codec := dto.NewCodec(ws.Subprotocol())
 	for {
-		_, message, err := ws.ReadMessage()
+		messageType, message, err := ws.ReadMessage()
 		if err != nil {
 			// Actively close the ssh session after the web socket session is closed
-			service.SessionService.CloseSessionById(sessionId, Normal, "Exited")
+			closeSession(Normal, "Exited")
 			break
 		}
 
-		msg, err := dto.ParseMessage(string(message))
+		msg, err := codec.Decode(messageType, message)
 		if err != nil {
 			continue
 		}
 
 		switch msg.Type {
 		case Resize:
-			decodeString, err := base64.StdEncoding.DecodeString(msg.Content)
-			if err != nil {
-				continue
-			}
-			var winSize dto.WindowSize
-			err = json.Unmarshal(decodeString, &winSize)
-			if err != nil {
-				continue
-			}
-			if err := termHandler.WindowChange(winSize.Rows, winSize.Cols); err != nil {
+			if err := termHandler.WindowChange(msg.Rows, msg.Cols); err != nil {
 			}
 		case Data:
 			input := []byte(msg.Content)
-			err := termHandler.Write(input)
+			err := termHandler.WriteAs(session.Owner, input)
 			if err != nil {
-				service.SessionService.CloseSessionById(sessionId, TunnelClosed, "Remote connection closed")
+				closeSession(TunnelClosed, "Remote connection closed")
+			}
+		case dto.Control:
+			if termHandler.control != nil && termHandler.activity != nil {
+				handleOwnerControl(termHandler.activity, msg)
+			}
+		case Transfer:
+			// Raw ZMODEM frames
+			if err := termHandler.WriteBinary(msg.Payload); err != nil {
+				closeSession(TunnelClosed, "Remote connection closed")
 			}
 		case Ping:
 			err := termHandler.SendRequest()
 			if err != nil {
-				service.SessionService.CloseSessionById(sessionId, TunnelClosed, "Remote connection closed")
+				closeSession(TunnelClosed, "Remote connection closed")
 			} else {
 				_ = termHandler.SendMessageToWebSocket(dto.NewMessage(Ping, ""))
 			}
-
+		case Ack:
+			termHandler.Ack(msg.Bytes)
+		case ZmodemEnd:
+			if err := termHandler.CancelZmodem(); err != nil {
+				closeSession(TunnelClosed, "Remote connection closed")
+			}
 		}
 	}
-	return err
 }
@@ -3,13 +3,18 @@ package api
 import (
 	"bytes"
 	"context"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
 	"quick-terminal/server/common/term"
 	"quick-terminal/server/dto"
+	"quick-terminal/server/event"
 	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
+	"quick-terminal/server/metrics"
 
 	"github.com/gorilla/websocket"
 )
@@ -21,12 +26,40 @@ type TermHandler struct {
 	quickTerminal *term.QuickTerminal
 	ctx           context.Context
 	cancel        context.CancelFunc
-	dataChan      chan rune
+	dataChan      chan []byte
 	tick          *time.Ticker
 	mutex         sync.Mutex
 	buf           bytes.Buffer
+	zmodemMutex   sync.Mutex
+	zmodem        *term.Zmodem
+	// zmodemCapable is set for clients that relay ZMODEM frames, others are
+	// sent transfers as terminal output
+	zmodemCapable bool
+	codec         dto.Codec
+	// activity is touched on input and output for the session timeouts
+	activity *session.Session
+	// conn owns the websocket, writing through it orders terminal output
+	// with notices and control messages sent to the same websocket
+	conn *session.Session
+
+	// control arbitrates the input of a shared session, nil for channels
+	control    *session.Control
+	inputMutex sync.Mutex
+	// inputParticipant typed the inputBytes not audited yet
+	inputParticipant string
+	inputBytes       int
+
+	// Flow control, enabled once the client acknowledges received bytes
+	flowControl int32
+	sent        int64
+	acked       int64
+	ackChan     chan struct{}
 }
 
+// flowControlWindow is the number of unacknowledged bytes after which reading
+// from the remote pauses.
+const flowControlWindow = 1024 * 1024
+
 func NewTermHandler(userId, assetId, sessionId string, isRecording bool, ws *websocket.Conn, quickTerminal *term.QuickTerminal) *TermHandler {
 	ctx, cancel := context.WithCancel(context.Background())
 	tick := time.NewTicker(time.Millisecond * time.Duration(60))
@@ -38,8 +71,10 @@ func NewTermHandler(userId, assetId, sessionId string, isRecording bool, ws *web
 		quickTerminal: quickTerminal,
 		ctx:           ctx,
 		cancel:        cancel,
-		dataChan:      make(chan rune),
+		dataChan:      make(chan []byte),
 		tick:          tick,
+		codec:         dto.NewCodec(ws.Subprotocol()),
+		ackChan:       make(chan struct{}, 1),
 	}
 }
 
@@ -52,20 +87,26 @@ func (r *TermHandler) Stop() {
 	// Record the last command when the session ends
 	r.tick.Stop()
 	r.cancel()
+	r.inputMutex.Lock()
+	r.flushInputAudit()
+	r.inputMutex.Unlock()
 }
 
 func (r *TermHandler) readFormTunnel() {
+	p := make([]byte, 32*1024)
 	for {
 		select {
 		case <-r.ctx.Done():
 			return
 		default:
-			rn, size, err := r.quickTerminal.StdoutReader.ReadRune()
+			n, err := r.quickTerminal.StdoutReader.Read(p)
 			if err != nil {
 				return
 			}
-			if size > 0 {
-				r.dataChan <- rn
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, p[:n])
+				r.dataChan <- data
 			}
 		}
 	}
@@ -77,40 +118,265 @@ func (r *TermHandler) writeToWebsocket() {
 		case <-r.ctx.Done():
 			return
 		case <-r.tick.C:
-			s := r.buf.String()
-			if s == "" {
-				continue
-			}
-			if err := r.SendMessageToWebSocket(dto.NewMessage(Data, s)); err != nil {
+			if err := r.flush(); err != nil {
 				return
 			}
-			// Record screen
-			if r.isRecording {
-				_ = r.quickTerminal.Recorder.WriteData(s)
-			}
-			// Monitor
-			SendObData(r.sessionId, s)
-			r.buf.Reset()
 		case data := <-r.dataChan:
-			if data != utf8.RuneError {
-				p := make([]byte, utf8.RuneLen(data))
-				utf8.EncodeRune(p, data)
-				r.buf.Write(p)
-			} else {
-				r.buf.Write([]byte("@"))
+			if err := r.writeOutput(data); err != nil {
+				return
 			}
 		}
 	}
 }
 
+// flush sends the buffered terminal output, an incomplete trailing UTF-8
+// sequence stays in the buffer until the rest of it arrives.
+func (r *TermHandler) flush() error {
+	s := decodeUtf8(&r.buf)
+	if s == "" {
+		return nil
+	}
+	if err := r.SendMessageToWebSocket(dto.NewMessage(Data, s)); err != nil {
+		return err
+	}
+	// Record screen
+	if r.isRecording {
+		_ = r.quickTerminal.Recorder.WriteData(s)
+	}
+	// Monitor
+	SendObData(r.sessionId, s)
+	return r.waitAck()
+}
+
+// Ack records the bytes the client has processed.
+func (r *TermHandler) Ack(n int64) {
+	atomic.StoreInt32(&r.flowControl, 1)
+	atomic.StoreInt64(&r.acked, n)
+	select {
+	case r.ackChan <- struct{}{}:
+	default:
+	}
+}
+
+func (r *TermHandler) waitAck() error {
+	if atomic.LoadInt32(&r.flowControl) == 0 {
+		return nil
+	}
+	for atomic.LoadInt64(&r.sent)-atomic.LoadInt64(&r.acked) > flowControlWindow {
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-r.ackChan:
+		}
+	}
+	return nil
+}
+
+func (r *TermHandler) writeOutput(data []byte) error {
+	if r.activity != nil {
+		r.activity.TouchOutput()
+		r.activity.AddBytesOut(len(data))
+	}
+	r.zmodemMutex.Lock()
+	zmodem := r.zmodem
+	r.zmodemMutex.Unlock()
+
+	if zmodem == nil {
+		if !r.zmodemCapable {
+			r.buf.Write(data)
+			return nil
+		}
+		direction, i := term.DetectZmodem(data)
+		if i < 0 {
+			r.buf.Write(data)
+			return nil
+		}
+		r.buf.Write(data[:i])
+		if err := r.flush(); err != nil {
+			return err
+		}
+		if err := r.startZmodem(direction); err != nil {
+			return err
+		}
+		return r.writeOutput(data[i:])
+	}
+
+	end := zmodem.Output(data)
+	if end < 0 {
+		if err := r.SendBinaryToWebSocket(data); err != nil {
+			return err
+		}
+		return r.waitAck()
+	}
+	if err := r.SendBinaryToWebSocket(data[:end]); err != nil {
+		return err
+	}
+	if err := r.stopZmodem(); err != nil {
+		return err
+	}
+	r.buf.Write(data[end:])
+	return nil
+}
+
+func (r *TermHandler) startZmodem(direction string) error {
+	r.zmodemMutex.Lock()
+	r.zmodem = term.NewZmodem(direction)
+	r.zmodemMutex.Unlock()
+	return r.SendMessageToWebSocket(dto.NewMessage(ZmodemStart, direction))
+}
+
+func (r *TermHandler) stopZmodem() error {
+	r.zmodemMutex.Lock()
+	zmodem := r.zmodem
+	r.zmodem = nil
+	r.zmodemMutex.Unlock()
+	if zmodem == nil {
+		return nil
+	}
+
+	// Audit the transfer
+	files, n, canceled := zmodem.Transfer()
+	log.Info("zmodem transfer",
+		log.String("sessionId", r.sessionId),
+		log.String("direction", zmodem.Direction),
+		log.Any("files", files),
+		log.Int64("bytes", n),
+		log.Bool("canceled", canceled),
+	)
+	connection := ""
+	if r.activity != nil {
+		connection = r.activity.History
+	}
+	for _, file := range files {
+		data := event.File{Operation: "zmodem-" + zmodem.Direction, Path: file.Name, Size: file.Size}
+		if canceled {
+			data.Error = "canceled"
+		}
+		event.Publish(event.New(event.FileOperation, r.sessionId, connection, data))
+	}
+	return r.SendMessageToWebSocket(dto.NewMessage(ZmodemEnd, ""))
+}
+
+func (r *TermHandler) touchInput(n int) {
+	if r.activity != nil {
+		r.activity.TouchInput()
+		r.activity.AddBytesIn(n)
+	}
+}
+
 func (r *TermHandler) Write(input []byte) error {
+	r.touchInput(len(input))
 	// Normal character input
 	_, err := r.quickTerminal.Write(input)
+	if err == nil && r.isRecording {
+		_ = r.quickTerminal.Recorder.WriteInput(string(input))
+	}
+	return err
+}
+
+// WriteAs relays input of a participant of a shared session, input of
+// participants not in control is dropped. Once a session is shared every
+// line of input is tagged with its participant in the audit log and the
+// recording.
+func (r *TermHandler) WriteAs(participant string, input []byte) error {
+	r.inputMutex.Lock()
+	defer r.inputMutex.Unlock()
+	if r.control != nil {
+		if !r.control.CanWrite(participant) {
+			return nil
+		}
+		if r.control.Shared() {
+			r.auditInput(participant, input)
+		}
+	}
+	return r.Write(input)
+}
+
+func (r *TermHandler) auditInput(participant string, input []byte) {
+	if participant != r.inputParticipant {
+		r.flushInputAudit()
+		r.inputParticipant = participant
+		if r.isRecording {
+			_ = r.quickTerminal.Recorder.WriteMarker("input: " + r.participantName(participant))
+		}
+	}
+	r.inputBytes += len(input)
+	if bytes.ContainsAny(input, "\r\n") {
+		r.flushInputAudit()
+	}
+}
+
+func (r *TermHandler) flushInputAudit() {
+	if r.inputBytes == 0 {
+		return
+	}
+	log.Info("session input",
+		log.String("sessionId", r.sessionId),
+		log.String("participant", r.inputParticipant),
+		log.String("name", r.participantName(r.inputParticipant)),
+		log.Int("bytes", r.inputBytes),
+	)
+	r.inputBytes = 0
+}
+
+func (r *TermHandler) participantName(participant string) string {
+	if participant == session.Owner || r.activity == nil || r.activity.Observer == nil {
+		return participant
+	}
+	if ob := r.activity.Observer.GetById(participant); ob != nil && ob.Principal != "" {
+		return ob.Principal
+	}
+	return participant
+}
+
+// WriteBinary relays raw ZMODEM frames sent by the browser.
+func (r *TermHandler) WriteBinary(input []byte) error {
+	r.touchInput(len(input))
+	r.zmodemMutex.Lock()
+	if r.zmodem == nil && r.zmodemCapable {
+		if direction, i := term.DetectZmodemInput(input); i >= 0 {
+			r.zmodem = term.NewZmodem(direction)
+		}
+	}
+	zmodem := r.zmodem
+	r.zmodemMutex.Unlock()
+
+	if zmodem != nil && zmodem.Input(input) >= 0 {
+		if err := r.stopZmodem(); err != nil {
+			return err
+		}
+	}
+	_, err := r.quickTerminal.Write(input)
 	return err
 }
 
+// CancelZmodem aborts a running transfer, e.g. when the user closes the file dialog.
+func (r *TermHandler) CancelZmodem() error {
+	r.zmodemMutex.Lock()
+	zmodem := r.zmodem
+	r.zmodemMutex.Unlock()
+	if zmodem == nil {
+		return nil
+	}
+	zmodem.Cancel()
+	if _, err := r.quickTerminal.Write(term.ZmodemAbort); err != nil {
+		return err
+	}
+	return r.stopZmodem()
+}
+
 func (r *TermHandler) WindowChange(h int, w int) error {
-	return r.quickTerminal.WindowChange(h, w)
+	if err := r.quickTerminal.WindowChange(h, w); err != nil {
+		return err
+	}
+	if r.isRecording {
+		_ = r.quickTerminal.Recorder.WriteResize(w, h)
+	}
+	SendObResize(r.sessionId, w, h)
+	if r.activity != nil {
+		event.Publish(event.New(event.SessionResized, r.activity.ID, r.activity.History, event.Resized{Cols: w, Rows: h}))
+	}
+	return nil
 }
 
 func (r *TermHandler) SendRequest() error {
@@ -122,17 +388,91 @@ func (r *TermHandler) SendMessageToWebSocket(msg dto.Message) error {
 	if r.webSocket == nil {
 		return nil
 	}
+	if msg.Type == Data || msg.Type == Transfer {
+		atomic.AddInt64(&r.sent, int64(len(msg.Content)+len(msg.Payload)))
+	}
+	if r.conn != nil {
+		return r.conn.WriteMessage(msg)
+	}
+	messageType, message, err := r.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
 	defer r.mutex.Unlock()
 	r.mutex.Lock()
-	message := []byte(msg.ToString())
-	return r.webSocket.WriteMessage(websocket.TextMessage, message)
+	if err := r.webSocket.WriteMessage(messageType, message); err != nil {
+		mode := ""
+		if r.activity != nil {
+			mode = r.activity.Mode
+		}
+		metrics.WebsocketWriteError(mode)
+		return err
+	}
+	return nil
+}
+
+func (r *TermHandler) SendBinaryToWebSocket(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	msg := dto.NewMessage(Transfer, "")
+	msg.Payload = p
+	return r.SendMessageToWebSocket(msg)
+}
+
+func decodeUtf8(buf *bytes.Buffer) string {
+	p := buf.Bytes()
+	var sb strings.Builder
+	for len(p) > 0 {
+		rn, size := utf8.DecodeRune(p)
+		if rn == utf8.RuneError && size <= 1 {
+			if !utf8.FullRune(p) {
+				break
+			}
+			sb.WriteString("@")
+		} else {
+			sb.WriteRune(rn)
+		}
+		p = p[size:]
+	}
+	rest := append([]byte(nil), p...)
+	buf.Reset()
+	buf.Write(rest)
+	return sb.String()
 }
 
 func SendObData(sessionId, s string) {
+	sendObMessage(sessionId, dto.NewMessage(Data, s), func(shadow *term.Shadow, send func()) {
+		shadow.Write(s, send)
+	})
+}
+
+// SendObResize tells observers that the terminal of the session changed size.
+func SendObResize(sessionId string, cols, rows int) {
+	sendObMessage(sessionId, dto.Message{Type: Resize, Cols: cols, Rows: rows}, func(shadow *term.Shadow, send func()) {
+		shadow.Resize(cols, rows, send)
+	})
+}
+
+// sendObMessage queues msg for the observers of a session while update has
+// the shadow of the session locked, observers whose queue is full are
+// dropped.
+func sendObMessage(sessionId string, msg dto.Message, update func(shadow *term.Shadow, send func())) {
 	quickSession := session.GlobalSessionManager.GetById(sessionId)
-	if quickSession != nil && quickSession.Observer != nil {
+	if quickSession == nil || quickSession.Observer == nil {
+		return
+	}
+	send := func() {
 		quickSession.Observer.Range(func(key string, ob *session.Session) {
-			_ = ob.WriteMessage(dto.NewMessage(Data, s))
+			if !ob.Send(msg) {
+				log.Warn("observer fell behind, dropped", log.String("sessionId", sessionId), log.String("observer", key))
+				quickSession.Observer.Del(key)
+			}
 		})
 	}
+	if quickSession.Shadow == nil {
+		send()
+		return
+	}
+	update(quickSession.Shadow, send)
 }
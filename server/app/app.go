@@ -1,10 +1,16 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"quick-terminal/server/config"
+	"quick-terminal/server/event"
+	"quick-terminal/server/metrics"
+	"quick-terminal/server/repository"
+	"quick-terminal/server/service"
 
 	"github.com/labstack/echo/v4"
 )
@@ -13,6 +19,9 @@ var app *App
 
 type App struct {
 	Server *echo.Echo
+	// stop ends the background tasks run by runTask, tasks counts them
+	stop  context.CancelFunc
+	tasks sync.WaitGroup
 }
 
 func newApp() *App {
@@ -25,7 +34,28 @@ func init() {
 
 func Run() error {
 
+	if err := config.Init(); err != nil {
+		return err
+	}
+
+	if err := service.RecordingService.LoadSigningKey(); err != nil {
+		return err
+	}
+
+	if path := config.GlobalCfg.Database.Path; path != "" {
+		if err := repository.Init(path); err != nil {
+			return err
+		}
+	}
+
+	setupEvents()
 	app.Server = setupRoutes()
+	metrics.RegisterActiveSessions(service.SessionService.ObserveActive)
+
+	ctx, stop := context.WithCancel(context.Background())
+	app.stop = stop
+	app.runTask(ctx, service.RecordingService.RunCleanup)
+	app.runTask(ctx, service.CommandService.RunIndexer)
 
 	if config.GlobalCfg.Debug {
 		jsonBytes, err := json.MarshalIndent(config.GlobalCfg, "", "    ")
@@ -35,9 +65,26 @@ func Run() error {
 		fmt.Printf("Current configuration: %v\n", string(jsonBytes))
 	}
 
-	if config.GlobalCfg.Server.Cert != "" && config.GlobalCfg.Server.Key != "" {
-		return app.Server.StartTLS(config.GlobalCfg.Server.Addr, config.GlobalCfg.Server.Cert, config.GlobalCfg.Server.Key)
-	} else {
-		return app.Server.Start(config.GlobalCfg.Server.Addr)
+	return serve()
+}
+
+// runTask runs a background task until it returns, it is stopped by the
+// shutdown.
+func (app *App) runTask(ctx context.Context, task func(ctx context.Context)) {
+	app.tasks.Add(1)
+	go func() {
+		defer app.tasks.Done()
+		task(ctx)
+	}()
+}
+
+// setupEvents subscribes the configured webhooks to the session events.
+func setupEvents() {
+	cfg := config.GlobalCfg.Events
+	for _, webhook := range cfg.Webhooks {
+		if webhook.URL == "" {
+			continue
+		}
+		event.Subscribe("webhook "+webhook.URL, event.NewWebhook(webhook.URL, webhook.Secret, webhook.Types, cfg.Retries, cfg.Timeout, cfg.DeadLetter))
 	}
 }
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Auth authenticates management requests by a bearer token, or the token
+// query parameter for players and websockets, and requires one of roles
+// when given. Without configured tokens every request is refused.
+func Auth(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal := lookupToken(requestToken(c))
+			if principal == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+			}
+			if len(roles) > 0 {
+				allowed := false
+				for _, role := range roles {
+					allowed = allowed || principal.HasRole(role)
+				}
+				if !allowed {
+					return echo.NewHTTPError(http.StatusForbidden, nt.ErrPermissionDenied.Error())
+				}
+			}
+			c.Set(nt.Principal, principal)
+			return next(c)
+		}
+	}
+}
+
+// Identify authenticates session requests like Auth but lets anonymous
+// requests through, the principal of a session is the authenticated one
+// and never taken from the client. A wrong token is refused.
+func Identify(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := requestToken(c)
+		if token == "" {
+			return next(c)
+		}
+		principal := lookupToken(token)
+		if principal == nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+		}
+		c.Set(nt.Principal, principal)
+		return next(c)
+	}
+}
+
+func requestToken(c echo.Context) string {
+	token := c.QueryParam("token")
+	if authorization := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return token
+}
+
+func lookupToken(token string) *config.AuthToken {
+	if token == "" || config.GlobalCfg.Auth == nil {
+		return nil
+	}
+	for i := range config.GlobalCfg.Auth.Tokens {
+		t := &config.GlobalCfg.Auth.Tokens[i]
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+
+	"quick-terminal/server/service"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Accepting refuses new sessions once the server shuts down. It counts the
+// running session handlers, so that the shutdown waits for them to close
+// their recordings.
+func Accepting(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !service.SessionService.Enter() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "server is shutting down")
+		}
+		defer service.SessionService.Leave()
+		return next(c)
+	}
+}
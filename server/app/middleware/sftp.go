@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"path"
+	"time"
+
+	"quick-terminal/server/event"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/metrics"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Sftp counts and times an SFTP endpoint as operation and publishes it as a
+// file operation event.
+func Sftp(operation string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			metrics.SftpOperation(operation, start, err)
+
+			sessionId := c.Param("id")
+			connection := ""
+			if s := session.GlobalSessionManager.GetById(sessionId); s != nil {
+				connection = s.History
+			}
+			data := sftpFile(c, operation)
+			if err != nil {
+				data.Error = err.Error()
+			}
+			event.Publish(event.New(event.FileOperation, sessionId, connection, data))
+			return err
+		}
+	}
+}
+
+// sftpFile reads the paths of an SFTP operation from the parameters of its
+// endpoint.
+func sftpFile(c echo.Context, operation string) event.File {
+	param := func(name string) string {
+		if value := c.QueryParam(name); value != "" {
+			return value
+		}
+		return c.FormValue(name)
+	}
+	data := event.File{Operation: operation}
+	switch operation {
+	case "upload":
+		data.Path = param("dir")
+		if file, err := c.FormFile("file"); err == nil {
+			data.Path = path.Join(data.Path, file.Filename)
+		}
+	case "rename":
+		data.Path = param("oldName")
+		data.NewPath = param("newName")
+	case "ls", "mkdir":
+		data.Path = param("dir")
+	default:
+		data.Path = param("file")
+	}
+	return data
+}
@@ -7,8 +7,10 @@ import (
 
 	"quick-terminal/server/api"
 	mw "quick-terminal/server/app/middleware"
+	"quick-terminal/server/common/nt"
 	"quick-terminal/server/config"
 	"quick-terminal/server/log"
+	"quick-terminal/server/metrics"
 	"quick-terminal/server/resource"
 
 	"github.com/labstack/echo/v4"
@@ -38,10 +40,26 @@ func WrapHandler(h http.Handler) echo.HandlerFunc {
 	}
 }
 
+// ipExtractor takes client IPs from X-Forwarded-For when the request comes
+// from a trusted proxy, else from the connection, so that clients cannot
+// choose the IP recorded for their sessions.
+func ipExtractor() echo.IPExtractor {
+	proxies, _ := config.GlobalCfg.Server.TrustedProxyNets()
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
 func setupRoutes() *echo.Echo {
 
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = ipExtractor()
 	//e.Logger = log.GetEchoLogger()
 	//e.Use(log.Hook())
 
@@ -61,23 +79,74 @@ func setupRoutes() *echo.Echo {
 	e.Use(mw.ErrorHandler)
 	e.Use(middleware.Gzip())
 
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
+	healthApi := new(api.HealthApi)
+	e.GET("/healthz", healthApi.LivenessEndpoint)
+	e.GET("/readyz", healthApi.ReadinessEndpoint)
+
 	guacamoleApi := new(api.GuacamoleApi)
 	webTerminalApi := new(api.WebTerminalApi)
 	SessionApi := new(api.SessionApi)
+	recordingApi := new(api.RecordingApi)
+	commandApi := new(api.CommandApi)
+	shareApi := new(api.ShareApi)
+	adminApi := new(api.AdminApi)
+	historyApi := new(api.HistoryApi)
 
 	quick := e.Group("/quick")
 	{
-		quick.POST("", SessionApi.SessionCreateEndpoint)
-		quick.GET("/:id/tunnel", guacamoleApi.Guacamole)
-		quick.GET("/:id/ssh", webTerminalApi.SshEndpoint)
-
-		quick.POST("/:id/ls", SessionApi.SessionLsEndpoint)
-		quick.GET("/:id/download", SessionApi.SessionDownloadEndpoint)
-		quick.POST("/:id/upload", SessionApi.SessionUploadEndpoint)
-		quick.POST("/:id/edit", SessionApi.SessionEditEndpoint)
-		quick.POST("/:id/mkdir", SessionApi.SessionMkDirEndpoint)
-		quick.POST("/:id/rm", SessionApi.SessionRmEndpoint)
-		quick.POST("/:id/rename", SessionApi.SessionRenameEndpoint)
+		quick.POST("", SessionApi.SessionCreateEndpoint, mw.Accepting)
+		quick.GET("/:id/tunnel", guacamoleApi.Guacamole, mw.Accepting, mw.Identify)
+		quick.GET("/:id/tunnel/monitor", guacamoleApi.GuacamoleMonitorEndpoint, mw.Accepting, mw.Auth(nt.RoleAdmin, nt.RoleAuditor))
+		quick.GET("/:id/ssh", webTerminalApi.SshEndpoint, mw.Accepting, mw.Identify)
+		quick.GET("/:id/ssh/channel", webTerminalApi.SshChannelEndpoint, mw.Accepting, mw.Identify)
+		quick.GET("/:id/monitor", webTerminalApi.SshMonitorEndpoint, mw.Accepting, mw.Auth(nt.RoleAdmin, nt.RoleAuditor))
+		quick.GET("/:id/join", shareApi.ShareJoinEndpoint, mw.Accepting)
+		quick.GET("/:id/shares", shareApi.ShareListEndpoint, mw.Auth())
+		quick.POST("/:id/shares", shareApi.ShareCreateEndpoint, mw.Auth())
+		quick.DELETE("/:id/shares/:token", shareApi.ShareRevokeEndpoint, mw.Auth())
+		quick.PUT("/:id/control", shareApi.ShareModeEndpoint, mw.Auth())
+
+		quick.POST("/:id/ls", SessionApi.SessionLsEndpoint, mw.Sftp("ls"))
+		quick.GET("/:id/download", SessionApi.SessionDownloadEndpoint, mw.Sftp("download"))
+		quick.POST("/:id/upload", SessionApi.SessionUploadEndpoint, mw.Sftp("upload"))
+		quick.POST("/:id/edit", SessionApi.SessionEditEndpoint, mw.Sftp("edit"))
+		quick.POST("/:id/mkdir", SessionApi.SessionMkDirEndpoint, mw.Sftp("mkdir"))
+		quick.POST("/:id/rm", SessionApi.SessionRmEndpoint, mw.Sftp("rm"))
+		quick.POST("/:id/rename", SessionApi.SessionRenameEndpoint, mw.Sftp("rename"))
+	}
+
+	recordings := quick.Group("/recordings", mw.Auth())
+	{
+		recordings.GET("", recordingApi.RecordingListEndpoint)
+		recordings.GET("/:id", recordingApi.RecordingGetEndpoint)
+		recordings.GET("/:id/download", recordingApi.RecordingDownloadEndpoint)
+		recordings.GET("/:id/stream", recordingApi.RecordingStreamEndpoint)
+		recordings.GET("/:id/verify", recordingApi.RecordingVerifyEndpoint)
+		recordings.GET("/:id/export", recordingApi.RecordingExportEndpoint)
+		recordings.GET("/:id/commands", commandApi.RecordingCommandsEndpoint)
+		recordings.GET("/:id/keys", recordingApi.RecordingKeysEndpoint)
+	}
+
+	admin := quick.Group("/admin", mw.Auth(nt.RoleAdmin))
+	{
+		admin.GET("/sessions", adminApi.SessionListEndpoint)
+		admin.DELETE("/sessions/:id", adminApi.SessionKillEndpoint)
+		admin.POST("/sessions/kill", adminApi.SessionKillAllEndpoint)
+		admin.POST("/notice", adminApi.NoticeEndpoint)
+		admin.GET("/diagnostics", healthApi.DiagnosticsEndpoint)
+	}
+
+	history := quick.Group("/history", mw.Auth())
+	{
+		history.GET("", historyApi.HistoryListEndpoint)
+		history.GET("/:id", historyApi.HistoryGetEndpoint)
+	}
+
+	commands := quick.Group("/commands", mw.Auth())
+	{
+		commands.GET("", commandApi.CommandSearchEndpoint)
 	}
 
 	return e
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"quick-terminal/server/api"
+	"quick-terminal/server/config"
+	"quick-terminal/server/event"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
+	"quick-terminal/server/repository"
+	"quick-terminal/server/service"
+)
+
+// shutdownGrace bounds each step of the shutdown after the drain.
+const shutdownGrace = 10 * time.Second
+
+const shutdownNotice = "The server is shutting down, this session will be closed in %s."
+
+// serve runs the server until it fails or SIGTERM or SIGINT is received,
+// then shuts it down gracefully.
+func serve() error {
+	errs := make(chan error, 1)
+	go func() {
+		if config.GlobalCfg.Server.Cert != "" && config.GlobalCfg.Server.Key != "" {
+			errs <- app.Server.StartTLS(config.GlobalCfg.Server.Addr, config.GlobalCfg.Server.Cert, config.GlobalCfg.Server.Key)
+		} else {
+			errs <- app.Server.Start(config.GlobalCfg.Server.Addr)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Info("shutting down", log.String("signal", sig.String()))
+	}
+	return shutdown(config.GlobalCfg.Server.DrainTimeout)
+}
+
+// shutdown refuses new sessions and lets the connected ones go on for up to
+// drainTimeout, then closes them. It returns once their recordings were
+// closed, the pending events were handed to the subscribers and the
+// background tasks stopped.
+func shutdown(drainTimeout time.Duration) error {
+	service.SessionService.Drain()
+	if n := service.SessionService.Broadcast(service.SessionFilter{}, "warning", fmt.Sprintf(shutdownNotice, drainTimeout)); n > 0 {
+		log.Info("draining sessions", log.Int("sessions", n), log.Duration("timeout", drainTimeout))
+		waitFor(drainTimeout, func() bool {
+			return session.GlobalSessionManager.Len() == 0
+		})
+	}
+
+	// The handlers close the recordings of their sessions as they return,
+	// sessions still connecting when the drain began are closed as they appear
+	if !waitFor(shutdownGrace, func() bool {
+		session.GlobalSessionManager.Range(func(id string, s *session.Session) {
+			service.SessionService.CloseSessionById(id, api.ServerShutdown, "Server shut down")
+		})
+		return service.SessionService.Handlers() == 0
+	}) {
+		log.Warn("session handlers still running", log.Int64("handlers", service.SessionService.Handlers()))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		event.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(shutdownGrace):
+		log.Warn("pending events not delivered")
+	}
+
+	// The retention cleanup and the command indexer write to the database
+	app.stop()
+	stopped := make(chan struct{})
+	go func() {
+		app.tasks.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownGrace):
+		log.Warn("background tasks still running")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	err := app.Server.Shutdown(ctx)
+	if e := repository.Close(); err == nil {
+		err = e
+	}
+	log.Info("shut down")
+	return err
+}
+
+// waitFor polls done until it reports true or timeout passed, it reports
+// whether done did.
+func waitFor(timeout time.Duration, done func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
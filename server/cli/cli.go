@@ -0,0 +1,12 @@
+package cli
+
+// Command is a subcommand of the quick-terminal binary, args excludes the
+// subcommand name itself.
+type Command func(args []string) error
+
+// Commands are dispatched by main before the server starts.
+var Commands = map[string]Command{
+	"connect": Connect,
+	"verify":  Verify,
+	"export":  Export,
+}
@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quick-terminal/server/dto"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/pflag"
+	"golang.org/x/term"
+)
+
+// Connect opens a terminal websocket such as /quick/:id/ssh from the local
+// terminal, e.g. quick-terminal connect 'wss://host/quick/ssh_1/ssh?payload=...'
+func Connect(args []string) error {
+	flags := pflag.NewFlagSet("connect", pflag.ContinueOnError)
+	protocol := flags.String("protocol", "", "terminal protocol: v1, json or cbor, negotiated when empty")
+	insecure := flags.Bool("insecure", false, "skip TLS certificate verification")
+	ping := flags.Duration("ping", 10*time.Second, "keep-alive interval")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: quick-terminal connect [flags] <url>")
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("stdin is not a terminal")
+	}
+	cols, rows, err := term.GetSize(fd)
+	if err != nil {
+		return err
+	}
+
+	target, err := connectUrl(flags.Arg(0), cols, rows)
+	if err != nil {
+		return err
+	}
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: *insecure},
+	}
+	switch *protocol {
+	case "":
+		dialer.Subprotocols = dto.Subprotocols
+	case "v1":
+	case "json":
+		dialer.Subprotocols = []string{dto.SubprotocolV2Json}
+	case "cbor":
+		dialer.Subprotocols = []string{dto.SubprotocolV2Cbor}
+	default:
+		return fmt.Errorf("unknown protocol %q", *protocol)
+	}
+
+	ws, _, err := dialer.Dial(target, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	client := &terminalClient{
+		ws:    ws,
+		codec: dto.NewCodec(ws.Subprotocol()),
+		done:  make(chan struct{}),
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	go client.readInput(os.Stdin)
+	go client.watchResize(fd)
+	go client.keepAlive(*ping)
+
+	err = client.readOutput(os.Stdout)
+	close(client.done)
+	return err
+}
+
+// connectUrl converts http(s) urls to ws(s) and fills in the terminal size.
+func connectUrl(raw string, cols, rows int) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	query := u.Query()
+	if query.Get("cols") == "" {
+		query.Set("cols", strconv.Itoa(cols))
+	}
+	if query.Get("rows") == "" {
+		query.Set("rows", strconv.Itoa(rows))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+type terminalClient struct {
+	ws    *websocket.Conn
+	codec dto.Codec
+	mutex sync.Mutex
+	done  chan struct{}
+}
+
+func (c *terminalClient) send(msg dto.Message) error {
+	messageType, p, err := c.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ws.WriteMessage(messageType, p)
+}
+
+func (c *terminalClient) readInput(r io.Reader) {
+	p := make([]byte, 4096)
+	for {
+		n, err := r.Read(p)
+		if err != nil {
+			return
+		}
+		if err := c.send(dto.NewMessage(dto.Data, string(p[:n]))); err != nil {
+			return
+		}
+	}
+}
+
+func (c *terminalClient) watchResize(fd int) {
+	signals := make(chan os.Signal, 1)
+	notifyResize(signals)
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-signals:
+			cols, rows, err := term.GetSize(fd)
+			if err != nil {
+				continue
+			}
+			msg := dto.NewMessage(dto.Resize, "")
+			msg.Cols = cols
+			msg.Rows = rows
+			_ = c.send(msg)
+		}
+	}
+}
+
+func (c *terminalClient) keepAlive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick.C:
+			if err := c.send(dto.NewMessage(dto.Ping, "")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *terminalClient) readOutput(w io.Writer) error {
+	for {
+		messageType, p, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		msg, err := c.codec.Decode(messageType, p)
+		if err != nil {
+			continue
+		}
+		switch msg.Type {
+		case dto.Data:
+			if _, err := io.WriteString(w, msg.Content); err != nil {
+				return err
+			}
+		case dto.Closed:
+			if msg.Content != "" {
+				_, _ = fmt.Fprintf(os.Stderr, "\r\n%s\r\n", msg.Content)
+			}
+			return nil
+		case dto.Notice:
+			_, _ = fmt.Fprintf(os.Stderr, "\r\n[%s]\r\n", strings.TrimSpace(msg.Content))
+		case dto.ZmodemStart:
+			// File transfers need the browser, cancel them
+			_, _ = fmt.Fprint(os.Stderr, "\r\n[file transfer is not supported, canceled]\r\n")
+			_ = c.send(dto.NewMessage(dto.ZmodemEnd, ""))
+		case dto.Ping, dto.Connected, dto.ZmodemEnd, dto.Transfer:
+		}
+	}
+}
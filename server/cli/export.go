@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"quick-terminal/server/common/term"
+
+	"github.com/spf13/pflag"
+)
+
+// Export converts an asciicast recording to a plain text transcript or a
+// self-contained HTML player, e.g.
+// quick-terminal export --format html -o session.html /usr/local/quick-terminal/data/recording/<id>
+func Export(args []string) error {
+	flags := pflag.NewFlagSet("export", pflag.ContinueOnError)
+	format := flags.String("format", "text", "output format: text or html")
+	output := flags.StringP("output", "o", "", "output file, standard output when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: quick-terminal export [--format text|html] [-o file] <recording directory or .cast file>")
+	}
+	if *format != "text" && *format != "html" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	reader, dir, err := openCast(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if *format == "html" {
+		commands, _ := term.ReadCommands(dir)
+		return term.WriteHtml(w, reader, path.Base(path.Clean(flags.Arg(0))), commands)
+	}
+	return term.WriteTranscript(w, reader)
+}
+
+// openCast opens a segmented recording directory, a directory holding
+// recording.cast or a .cast file.
+func openCast(name string) (io.ReadCloser, string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.IsDir() {
+		file, err := os.Open(name)
+		return file, path.Dir(name), err
+	}
+	if _, err := os.Stat(path.Join(name, term.RecordingIndexName)); err == nil {
+		reader, err := term.OpenRecording(name)
+		return reader, name, err
+	}
+	file, err := os.Open(path.Join(name, "recording.cast"))
+	return file, name, err
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"quick-terminal/server/common/term"
+
+	"github.com/spf13/pflag"
+)
+
+// Verify checks recording directories against their manifests, e.g.
+// quick-terminal verify --key recording.pub /usr/local/quick-terminal/data/recording/*
+func Verify(args []string) error {
+	flags := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	keyFile := flags.String("key", "", "Ed25519 public or private key in PEM format the manifests must be signed with")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: quick-terminal verify [--key file] <recording directory>...")
+	}
+
+	var key ed25519.PublicKey
+	if *keyFile != "" {
+		var err error
+		if key, err = term.LoadVerifyKey(*keyFile); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, dir := range flags.Args() {
+		verification, err := term.VerifyRecording(dir, key)
+		if err != nil {
+			failed++
+			fmt.Printf("%s: ERROR %v\n", dir, err)
+			continue
+		}
+		if !verification.Valid {
+			failed++
+			fmt.Printf("%s: TAMPERED\n", dir)
+			for _, problem := range verification.Problems {
+				fmt.Printf("  %s\n", problem)
+			}
+			continue
+		}
+		status := "OK"
+		switch {
+		case !verification.Signed:
+			status += " (unsigned)"
+		case !verification.Trusted:
+			status += " (signature not checked against a trusted key)"
+		}
+		if !verification.Complete {
+			status += " (incomplete)"
+		}
+		if verification.Files > 0 {
+			fmt.Printf("%s: %s, %d files\n", dir, status, verification.Files)
+			continue
+		}
+		fmt.Printf("%s: %s, %d segments\n", dir, status, verification.Segments)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d recordings failed verification", failed, flags.NArg())
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package cli
+
+import "os"
+
+// Windows has no SIGWINCH, the size is only sent once when connecting.
+func notifyResize(c chan<- os.Signal) {
+}
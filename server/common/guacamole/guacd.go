@@ -17,6 +17,7 @@ const (
 	EnableRecording     = "enable-recording"
 	RecordingPath       = "recording-path"
 	CreateRecordingPath = "create-recording-path"
+	RecordingName       = "recording-name"
 
 	FontName     = "font-name"
 	FontSize     = "font-size"
@@ -233,6 +234,29 @@ func NewTunnel(address string, config *Configuration) (ret *Tunnel, err error) {
 	return ret, nil
 }
 
+// Probe performs the first step of a handshake with guacd at address, it
+// selects protocol and returns the args guacd answers with. The protocol
+// version guacd speaks is the arg starting with "VERSION".
+func Probe(address, protocol string, timeout time.Duration) (args Instruction, err error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return args, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return args, err
+	}
+	tunnel := &Tunnel{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	if err := tunnel.WriteInstructionAndFlush(NewInstruction("select", protocol)); err != nil {
+		return args, err
+	}
+	return tunnel.expect("args")
+}
+
 func (opt *Tunnel) WriteInstructionAndFlush(instruction Instruction) error {
 	if _, err := opt.WriteAndFlush([]byte(instruction.String())); err != nil {
 		return err
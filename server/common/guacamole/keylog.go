@@ -0,0 +1,376 @@
+package guacamole
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// KeyLogName is the keystroke log of a guacd session, next to its recording.
+const KeyLogName = "keys.log"
+
+const (
+	// keyLogPause ends a line of typed keys when no key was pressed for this long
+	keyLogPause = 2 * time.Second
+	// maxClipboard is the most clipboard content logged per paste
+	maxClipboard = 64 * 1024
+)
+
+var keysymNames = map[int]string{
+	0xff08: "BackSpace",
+	0xff09: "Tab",
+	0xff0d: "Enter",
+	0xff13: "Pause",
+	0xff14: "ScrollLock",
+	0xff15: "SysReq",
+	0xff1b: "Esc",
+	0xff50: "Home",
+	0xff51: "Left",
+	0xff52: "Up",
+	0xff53: "Right",
+	0xff54: "Down",
+	0xff55: "PageUp",
+	0xff56: "PageDown",
+	0xff57: "End",
+	0xff61: "Print",
+	0xff63: "Insert",
+	0xff67: "Menu",
+	0xff7f: "NumLock",
+	0xff8d: "Enter",
+	0xffe5: "CapsLock",
+	0xffff: "Delete",
+}
+
+var keypadChars = map[int]rune{
+	0xff80: ' ',
+	0xffaa: '*',
+	0xffab: '+',
+	0xffac: ',',
+	0xffad: '-',
+	0xffae: '.',
+	0xffaf: '/',
+	0xffbd: '=',
+}
+
+// Modifier keysyms, left and right keys map to the same modifier.
+var keysymModifiers = map[int]string{
+	0xffe1: "Shift",
+	0xffe2: "Shift",
+	0xffe3: "Ctrl",
+	0xffe4: "Ctrl",
+	0xffe7: "Meta",
+	0xffe8: "Meta",
+	0xffe9: "Alt",
+	0xffea: "Alt",
+	0xffeb: "Super",
+	0xffec: "Super",
+	0xfe03: "AltGr",
+}
+
+// modifierOrder is the order modifiers are written in.
+var modifierOrder = []string{"Ctrl", "Alt", "AltGr", "Meta", "Super", "Shift"}
+
+// KeysymRune returns the character typed by keysym, if any.
+func KeysymRune(keysym int) (rune, bool) {
+	switch {
+	case keysym >= 0x20 && keysym <= 0x7e, keysym >= 0xa0 && keysym <= 0xff:
+		return rune(keysym), true
+	case keysym >= 0x01000100 && keysym <= 0x0110ffff:
+		r := rune(keysym - 0x01000000)
+		return r, unicode.IsPrint(r)
+	case keysym >= 0xffb0 && keysym <= 0xffb9:
+		return rune('0' + keysym - 0xffb0), true
+	}
+	r, ok := keypadChars[keysym]
+	return r, ok
+}
+
+// KeysymName returns the name of a key that does not type a character,
+// "F1" to "F24", a name such as "Enter", or the keysym in hex.
+func KeysymName(keysym int) string {
+	if name, ok := keysymNames[keysym]; ok {
+		return name
+	}
+	if name, ok := keysymModifiers[keysym]; ok {
+		return name
+	}
+	if keysym >= 0xffbe && keysym <= 0xffd5 {
+		return "F" + strconv.Itoa(keysym-0xffbe+1)
+	}
+	return fmt.Sprintf("0x%x", keysym)
+}
+
+type clipboardStream struct {
+	typist   string
+	time     float64
+	mimetype string
+	data     bytes.Buffer
+	size     int
+}
+
+// KeyLogger writes a readable log of the keys pressed and the clipboard
+// content sent by the client of a guacd session, decoded from the "key",
+// "clipboard", "blob" and "end" instructions it sends.
+//
+// Each line holds the seconds since the start of the session, the event and
+// its text. Typed characters are collected on a "keys" line until Enter or
+// a pause, other keys are written as <Name> and key combinations as
+// <Ctrl+Alt+Delete>, a literal "<" is written as "<<". Redacted characters
+// and clipboard content are replaced by the marker of the options. Events of
+// another typist than the user of the session, written with WriteAs, are
+// tagged like "keys@alice".
+type KeyLogger struct {
+	file    *os.File
+	writer  *bufio.Writer
+	start   time.Time
+	options KeyLogOptions
+	mutex   sync.Mutex
+	closed  bool
+
+	// keys holds the modifiers held down by each typist
+	keys     map[string]*keyState
+	typist   string
+	line     strings.Builder
+	redacted bool // the line ends with the marker
+	lineTime float64
+	lastKey  time.Time
+	streams  map[string]*clipboardStream
+}
+
+type keyState struct {
+	modifiers map[string]int
+	pressed   map[int]bool
+}
+
+// KeyLogOptions control what a KeyLogger redacts. Typed characters are
+// replaced when Keystrokes is set or within Window of the start of the log,
+// clipboard content when Clipboard is set.
+type KeyLogOptions struct {
+	Marker     string
+	Keystrokes bool
+	Window     time.Duration
+	Clipboard  bool
+}
+
+// NewKeyLogger starts the keystroke log in dir, creating dir if needed. The
+// log is only readable by its owner, it may hold what was typed.
+func NewKeyLogger(dir string, options KeyLogOptions) (*KeyLogger, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path.Join(dir, KeyLogName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyLogger{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		start:   time.Now(),
+		options: options,
+		keys:    make(map[string]*keyState),
+		streams: make(map[string]*clipboardStream),
+	}, nil
+}
+
+// Write logs the instructions of a message from the client, other
+// instructions are ignored.
+func (l *KeyLogger) Write(message []byte) error {
+	return l.WriteAs("", message)
+}
+
+// WriteAs logs a message from typist, another client joined to the session.
+func (l *KeyLogger) WriteAs(typist string, message []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	reader := NewInstructionReader(bytes.NewReader(message))
+	for {
+		_, instruction, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch instruction.Opcode {
+		case "key":
+			if len(instruction.Args) == 2 {
+				keysym, err := strconv.Atoi(instruction.Args[0])
+				if err == nil {
+					l.key(typist, keysym, instruction.Args[1] == "1")
+				}
+			}
+		case "clipboard":
+			if len(instruction.Args) == 2 {
+				l.streams[typist+"/"+instruction.Args[0]] = &clipboardStream{
+					typist:   typist,
+					time:     l.elapsed(),
+					mimetype: instruction.Args[1],
+				}
+			}
+		case "blob":
+			if len(instruction.Args) == 2 {
+				l.blob(typist+"/"+instruction.Args[0], instruction.Args[1])
+			}
+		case "end":
+			if len(instruction.Args) == 1 {
+				l.end(typist + "/" + instruction.Args[0])
+			}
+		}
+	}
+	return l.writer.Flush()
+}
+
+func (l *KeyLogger) elapsed() float64 {
+	return time.Since(l.start).Seconds()
+}
+
+// event names an event of typist in the log.
+func event(name, typist string) string {
+	if typist == "" {
+		return name
+	}
+	return name + "@" + typist
+}
+
+func (l *KeyLogger) key(typist string, keysym int, pressed bool) {
+	state, ok := l.keys[typist]
+	if !ok {
+		state = &keyState{modifiers: make(map[string]int), pressed: make(map[int]bool)}
+		l.keys[typist] = state
+	}
+	if modifier, ok := keysymModifiers[keysym]; ok {
+		if pressed && !state.pressed[keysym] {
+			state.modifiers[modifier]++
+		} else if !pressed && state.pressed[keysym] && state.modifiers[modifier] > 0 {
+			state.modifiers[modifier]--
+		}
+		state.pressed[keysym] = pressed
+		return
+	}
+	if !pressed {
+		return
+	}
+
+	now := time.Now()
+	if l.line.Len() > 0 && (now.Sub(l.lastKey) > keyLogPause || typist != l.typist) {
+		l.flushLine()
+	}
+	l.lastKey = now
+	if l.line.Len() == 0 {
+		l.lineTime = l.elapsed()
+		l.typist = typist
+	}
+
+	r, printable := KeysymRune(keysym)
+	combination := state.modifiers["Ctrl"] > 0 || state.modifiers["Alt"] > 0 || state.modifiers["Meta"] > 0 || state.modifiers["Super"] > 0
+	redact := l.options.Keystrokes || now.Sub(l.start) < l.options.Window
+	switch {
+	case printable && !combination && redact:
+		// A run of redacted characters is written as a single marker
+		if !l.redacted {
+			l.line.WriteString(l.options.Marker)
+			l.redacted = true
+		}
+		return
+	case printable && !combination && r == '<':
+		l.line.WriteString("<<")
+	case printable && !combination:
+		// Shift and AltGr are part of the keysym
+		l.line.WriteRune(r)
+	default:
+		name := KeysymName(keysym)
+		if printable {
+			name = string(r)
+		}
+		var names []string
+		for _, modifier := range modifierOrder {
+			if state.modifiers[modifier] == 0 {
+				continue
+			}
+			if printable && (modifier == "Shift" || modifier == "AltGr") {
+				continue
+			}
+			names = append(names, modifier)
+		}
+		l.line.WriteString("<" + strings.Join(append(names, name), "+") + ">")
+	}
+	l.redacted = false
+	if keysym == 0xff0d || keysym == 0xff8d {
+		l.flushLine()
+	}
+}
+
+func (l *KeyLogger) flushLine() {
+	if l.line.Len() == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(l.writer, "%.3f %s %s\n", l.lineTime, event("keys", l.typist), l.line.String())
+	l.line.Reset()
+	l.redacted = false
+}
+
+func (l *KeyLogger) blob(index, data string) {
+	stream, ok := l.streams[index]
+	if !ok {
+		return
+	}
+	p, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return
+	}
+	stream.size += len(p)
+	if remaining := maxClipboard - stream.data.Len(); remaining > 0 {
+		if len(p) > remaining {
+			p = p[:remaining]
+		}
+		stream.data.Write(p)
+	}
+}
+
+func (l *KeyLogger) end(index string) {
+	stream, ok := l.streams[index]
+	if !ok {
+		return
+	}
+	delete(l.streams, index)
+	l.flushLine()
+	content := l.options.Marker
+	if !l.options.Clipboard {
+		if strings.HasPrefix(stream.mimetype, "text/") {
+			content = strconv.Quote(stream.data.String())
+		} else {
+			content = "(binary)"
+		}
+		if stream.size > stream.data.Len() {
+			content += " (truncated)"
+		}
+	}
+	_, _ = fmt.Fprintf(l.writer, "%.3f %s %s %d bytes %s\n", stream.time, event("clipboard", stream.typist), stream.mimetype, stream.size, content)
+}
+
+func (l *KeyLogger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.flushLine()
+	if err := l.writer.Flush(); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,212 @@
+package guacamole
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func instruction(opcode string, args ...string) string {
+	i := NewInstruction(opcode, args...)
+	return i.String()
+}
+
+// keys returns the instructions of a key press and release per keysym.
+func keys(keysyms ...string) string {
+	var b strings.Builder
+	for _, keysym := range keysyms {
+		b.WriteString(instruction("key", keysym, "1"))
+		b.WriteString(instruction("key", keysym, "0"))
+	}
+	return b.String()
+}
+
+func press(keysym string) string {
+	return instruction("key", keysym, "1")
+}
+
+func release(keysym string) string {
+	return instruction("key", keysym, "0")
+}
+
+// readKeyLog returns the lines of the log in dir without their times.
+func readKeyLog(t *testing.T, dir string) []string {
+	t.Helper()
+	p, err := os.ReadFile(path.Join(dir, KeyLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			line = line[i+1:]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestKeyLogger(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  KeyLogOptions
+		messages []string
+		want     []string
+	}{
+		{
+			name:     "characters",
+			messages: []string{keys("108", "115", "32", "45", "108") + keys("65293")},
+			want:     []string{"keys ls -l<Enter>"},
+		},
+		{
+			name:     "keypad and unicode",
+			messages: []string{keys("65457", "65451", "65458", "233", "16785580") + keys("65421")},
+			want:     []string{"keys 1+2é€<Enter>"},
+		},
+		{
+			name:     "literal less than",
+			messages: []string{keys("97", "60", "98")},
+			want:     []string{"keys a<<b"},
+		},
+		{
+			name:     "named keys",
+			messages: []string{keys("65307", "65470", "65481", "65535", "65288")},
+			want:     []string{"keys <Esc><F1><F12><Delete><BackSpace>"},
+		},
+		{
+			name:     "shift is part of the keysym",
+			messages: []string{press("65505") + keys("65") + release("65505")},
+			want:     []string{"keys A"},
+		},
+		{
+			name:     "combination",
+			messages: []string{press("65507") + press("65513") + keys("65535") + release("65513") + release("65507")},
+			want:     []string{"keys <Ctrl+Alt+Delete>"},
+		},
+		{
+			name:     "combination with a character",
+			messages: []string{press("65508") + press("65505") + keys("67") + release("65505") + release("65508")},
+			want:     []string{"keys <Ctrl+C>"},
+		},
+		{
+			name:     "left and right modifiers",
+			messages: []string{press("65507") + press("65508") + release("65507") + keys("99") + release("65508") + keys("99")},
+			want:     []string{"keys <Ctrl+c>c"},
+		},
+		{
+			name:     "modifier released",
+			messages: []string{press("65513") + release("65513") + keys("120")},
+			want:     []string{"keys x"},
+		},
+		{
+			name:     "repeated press of a modifier",
+			messages: []string{press("65507") + press("65507") + release("65507") + keys("120")},
+			want:     []string{"keys x"},
+		},
+		{
+			name:     "unknown keysym",
+			messages: []string{keys("65312")},
+			want:     []string{"keys <0xff20>"},
+		},
+		{
+			name:     "clipboard",
+			messages: []string{instruction("clipboard", "1", "text/plain"), instruction("blob", "1", "aGk="), instruction("end", "1")},
+			want:     []string{`clipboard text/plain 2 bytes "hi"`},
+		},
+		{
+			name:     "redacted clipboard",
+			options:  KeyLogOptions{Marker: "[REDACTED]", Clipboard: true},
+			messages: []string{instruction("clipboard", "1", "text/plain") + instruction("blob", "1", "aGk=") + instruction("end", "1")},
+			want:     []string{"clipboard text/plain 2 bytes [REDACTED]"},
+		},
+		{
+			name:     "redacted keystrokes",
+			options:  KeyLogOptions{Marker: "[REDACTED]", Keystrokes: true},
+			messages: []string{keys("112", "119", "65288", "100") + press("65507") + keys("117") + release("65507") + keys("65293")},
+			want:     []string{"keys [REDACTED]<BackSpace>[REDACTED]<Ctrl+u><Enter>"},
+		},
+		{
+			name:     "redaction window",
+			options:  KeyLogOptions{Marker: "[REDACTED]", Window: time.Hour},
+			messages: []string{keys("115", "101", "99", "114", "101", "116")},
+			want:     []string{"keys [REDACTED]"},
+		},
+		{
+			name:     "ignored instructions",
+			messages: []string{instruction("mouse", "10", "10", "1") + instruction("size", "1024", "768")},
+			want:     []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			logger, err := NewKeyLogger(dir, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range tt.messages {
+				if err := logger.Write([]byte(message)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := logger.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got := readKeyLog(t, dir)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyLoggerTypists(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewKeyLogger(dir, KeyLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Modifiers are held per typist
+	_ = logger.Write([]byte(press("65507") + keys("97")))
+	_ = logger.WriteAs("alice", []byte(keys("98")))
+	_ = logger.Write([]byte(keys("99")))
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"keys <Ctrl+a>", "keys@alice b", "keys <Ctrl+c>"}
+	if got := readKeyLog(t, dir); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	info, err := os.Stat(path.Join(dir, KeyLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode %o, want 600", mode)
+	}
+}
+
+func TestKeysymName(t *testing.T) {
+	tests := []struct {
+		keysym int
+		want   string
+	}{
+		{0xff0d, "Enter"},
+		{0xffbe, "F1"},
+		{0xffd5, "F24"},
+		{0xffe1, "Shift"},
+		{0xfe03, "AltGr"},
+		{0x1234, "0x1234"},
+	}
+	for _, tt := range tests {
+		if got := KeysymName(tt.keysym); got != tt.want {
+			t.Errorf("KeysymName(%#x) = %q, want %q", tt.keysym, got, tt.want)
+		}
+	}
+}
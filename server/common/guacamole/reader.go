@@ -0,0 +1,92 @@
+package guacamole
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+var ErrInvalidInstruction = errors.New("invalid instruction")
+
+// InstructionReader reads complete instructions from a guacamole protocol
+// stream, such as a .guac recording. Unlike Tunnel.Read it honours element
+// lengths, so delimiters inside values do not split instructions.
+type InstructionReader struct {
+	reader *bufio.Reader
+}
+
+func NewInstructionReader(r io.Reader) *InstructionReader {
+	return &InstructionReader{reader: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Read returns the raw protocol form of the next instruction and its parsed form.
+func (r *InstructionReader) Read() ([]byte, Instruction, error) {
+	var raw bytes.Buffer
+	var elements []string
+	for {
+		length, err := r.readLength(&raw)
+		if err != nil {
+			if err == io.EOF && raw.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, Instruction{}, err
+		}
+		value, err := r.readValue(&raw, length)
+		if err != nil {
+			return nil, Instruction{}, err
+		}
+		elements = append(elements, value)
+
+		terminator, err := r.reader.ReadByte()
+		if err != nil {
+			return nil, Instruction{}, err
+		}
+		raw.WriteByte(terminator)
+		switch terminator {
+		case ',':
+			continue
+		case Delimiter:
+			instruction := NewInstruction(elements[0], elements[1:]...)
+			instruction.ProtocolForm = raw.String()
+			return raw.Bytes(), instruction, nil
+		default:
+			return nil, Instruction{}, ErrInvalidInstruction
+		}
+	}
+}
+
+func (r *InstructionReader) readLength(raw *bytes.Buffer) (int, error) {
+	digits, err := r.reader.ReadBytes('.')
+	if err != nil {
+		return 0, err
+	}
+	raw.Write(digits)
+	length, err := strconv.Atoi(string(digits[:len(digits)-1]))
+	if err != nil || length < 0 {
+		return 0, ErrInvalidInstruction
+	}
+	return length, nil
+}
+
+// readValue reads length code points, the unit guacamole lengths are counted in.
+func (r *InstructionReader) readValue(raw *bytes.Buffer, length int) (string, error) {
+	start := raw.Len()
+	for i := 0; i < length; i++ {
+		rn, size, err := r.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if rn == utf8.RuneError && size == 1 {
+			// Keep invalid bytes as they are
+			_ = r.reader.UnreadRune()
+			b, _ := r.reader.ReadByte()
+			raw.WriteByte(b)
+			continue
+		}
+		raw.WriteRune(rn)
+	}
+	return string(raw.Bytes()[start:]), nil
+}
@@ -0,0 +1,86 @@
+package guacamole
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"sync"
+)
+
+// RecordingFile is the file a gateway-side recording is written to.
+const RecordingFile = "recording.guac"
+
+// activeRecordings holds the directories of recordings still being written.
+var activeRecordings sync.Map
+
+// IsActive reports whether the recording in dir is still being written.
+func IsActive(dir string) bool {
+	_, ok := activeRecordings.Load(path.Clean(dir))
+	return ok
+}
+
+// Recorder writes the instructions guacd sends to the client in the format
+// of guacd's own recordings, so guacenc and the guacamole-common-js player
+// can play them back. Recording in the gateway works wherever guacd runs.
+type Recorder struct {
+	Dir    string
+	file   *os.File
+	writer *bufio.Writer
+	mutex  sync.Mutex
+	closed bool
+}
+
+// NewRecorder creates a recording in dir, which must not exist yet.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(path.Dir(dir), 0777); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path.Join(dir, RecordingFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	activeRecordings.Store(path.Clean(dir), struct{}{})
+	return &Recorder{
+		Dir:    dir,
+		file:   file,
+		writer: bufio.NewWriterSize(file, 64*1024),
+	}, nil
+}
+
+// Write records data as received from guacd, instructions may be split
+// across calls. The file is flushed at every frame boundary so that the
+// recording can be followed while it is written.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := r.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if bytes.Contains(p, []byte("4.sync,")) {
+		err = r.writer.Flush()
+	}
+	return n, err
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	defer activeRecordings.Delete(path.Clean(r.Dir))
+	if err := r.writer.Flush(); err != nil {
+		_ = r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
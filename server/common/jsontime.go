@@ -47,6 +47,10 @@ func (j JsonTime) Value() (driver.Value, error) {
 }
 
 func (j *JsonTime) Scan(v interface{}) error {
+	if v == nil {
+		*j = JsonTime{}
+		return nil
+	}
 	value, ok := v.(time.Time)
 	if ok {
 		*j = JsonTime{Time: value}
@@ -54,3 +58,8 @@ func (j *JsonTime) Scan(v interface{}) error {
 	}
 	return fmt.Errorf("can not convert %v to timestamp", v)
 }
+
+// GormDataType stores JsonTime in datetime columns.
+func (j JsonTime) GormDataType() string {
+	return "datetime"
+}
@@ -28,6 +28,15 @@ const (
 	SocksProxyPassword = "socks-proxy-password"
 
 	Anonymous = "anonymous"
+
+	// Session history status
+	Connecting   = "connecting"
+	Connected    = "connected"
+	Disconnected = "disconnected"
+
+	Principal   = "principal" // echo context key of the authenticated *config.AuthToken
+	RoleAdmin   = "admin"
+	RoleAuditor = "auditor"
 )
 
 var SSHParameterNames = []string{guacamole.FontName, guacamole.FontSize, guacamole.ColorScheme, guacamole.Backspace, guacamole.TerminalType, SshMode, SocksProxyEnable, SocksProxyHost, SocksProxyPort, SocksProxyUsername, SocksProxyPassword}
@@ -0,0 +1,255 @@
+package term
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Command is a command line entered in a recorded session, Time is in
+// seconds from the start of the recording.
+type Command struct {
+	Time    float64 `json:"time"`
+	Command string  `json:"command"`
+}
+
+// RecordingCommandsName is the file the commands of an indexed recording are
+// stored in, next to the recording.
+const RecordingCommandsName = "commands.json"
+
+type commandsFile struct {
+	Version  int       `json:"version"`
+	Commands []Command `json:"commands"`
+}
+
+// WriteCommands stores the commands of the recording in dir.
+func WriteCommands(dir string, commands []Command) error {
+	if commands == nil {
+		commands = make([]Command, 0)
+	}
+	p, err := json.Marshal(commandsFile{Version: 1, Commands: commands})
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, RecordingCommandsName+".tmp")
+	if err := os.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, RecordingCommandsName))
+}
+
+// ReadCommands returns the commands of the recording in dir, nil if it was
+// not indexed yet.
+func ReadCommands(dir string) ([]Command, error) {
+	p, err := os.ReadFile(path.Join(dir, RecordingCommandsName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var file commandsFile
+	if err := json.Unmarshal(p, &file); err != nil {
+		return nil, err
+	}
+	return file.Commands, nil
+}
+
+// commandExtractor replays a recording on a Screen. With input events a
+// command is the text between the prompt and the cursor when Enter is
+// pressed, so line editing, completion and history are taken into account.
+// Without them, lines starting with prompt are taken as commands when the
+// cursor leaves them.
+type commandExtractor struct {
+	screen *Screen
+	prompt *regexp.Regexp
+	marker string
+
+	sawInput bool
+	// awaiting is set until the first key of the next command line
+	awaiting   bool
+	promptText string
+	promptRow  int
+	// enter is set when Enter was pressed but not echoed yet
+	enter     bool
+	enterTime float64
+	// redacted is set when the current line was replaced by the marker, the
+	// Enter ending it is redacted as well
+	redacted bool
+
+	fromInput  []Command
+	fromOutput []Command
+}
+
+// ExtractCommands returns the commands of an asciicast v2 recording in
+// order, lines with input replaced by marker are skipped.
+func ExtractCommands(r io.Reader, prompt *regexp.Regexp, marker string) ([]Command, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, err
+	}
+	e := &commandExtractor{
+		screen:   NewScreen(header.Width, header.Height),
+		prompt:   prompt,
+		marker:   marker,
+		awaiting: true,
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var event []interface{}
+			if json.Unmarshal(line, &event) == nil && len(event) == 3 {
+				t, _ := event[0].(float64)
+				code, _ := event[1].(string)
+				data, _ := event[2].(string)
+				e.event(t, code, data)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.enter {
+		e.emitInput(e.enterTime)
+	}
+	if e.sawInput {
+		return e.fromInput, nil
+	}
+	return e.fromOutput, nil
+}
+
+func (e *commandExtractor) event(t float64, code, data string) {
+	switch code {
+	case "o":
+		e.output(t, data)
+	case "i":
+		e.input(t, data)
+	case "r":
+		if cols, rows, ok := strings.Cut(data, "x"); ok {
+			w, _ := strconv.Atoi(cols)
+			h, _ := strconv.Atoi(rows)
+			e.screen.Resize(w, h)
+		}
+	}
+}
+
+func (e *commandExtractor) output(t float64, data string) {
+	for {
+		i := strings.IndexByte(data, '\n')
+		if i < 0 {
+			e.screen.Write(data)
+			return
+		}
+		e.screen.Write(data[:i])
+		if e.enter {
+			e.enter = false
+			e.emitInput(e.enterTime)
+		} else if e.redacted {
+			e.redacted = false
+			e.awaiting = true
+		}
+		e.checkPrompt(t)
+		e.screen.Write("\n")
+		data = data[i+1:]
+	}
+}
+
+func (e *commandExtractor) input(t float64, data string) {
+	e.sawInput = true
+	if e.screen.AltScreen() {
+		e.awaiting = true
+		e.enter = false
+		return
+	}
+	if e.enter {
+		// The previous line was never echoed, take what is on screen
+		e.enter = false
+		e.emitInput(e.enterTime)
+	}
+	if e.awaiting {
+		x, y := e.screen.Cursor()
+		line := []rune(e.screen.Line(y))
+		if x > len(line) {
+			x = len(line)
+		}
+		e.promptText = string(line[:x])
+		e.promptRow = y + e.screen.Scrolled()
+		e.awaiting = false
+	}
+	switch {
+	case e.marker != "" && data == e.marker:
+		e.redacted = true
+	case strings.ContainsAny(data, "\r\n"):
+		e.enter = true
+		e.enterTime = t
+	case strings.ContainsAny(data, "\x03\x04"):
+		e.awaiting = true
+	}
+}
+
+func (e *commandExtractor) emitInput(t float64) {
+	e.awaiting = true
+	if e.redacted {
+		e.redacted = false
+		return
+	}
+	line := e.commandLine()
+	if strings.HasPrefix(line, e.promptText) {
+		line = line[len(e.promptText):]
+	} else if e.prompt != nil {
+		if loc := e.prompt.FindStringIndex(line); loc != nil {
+			line = line[loc[1]:]
+		}
+	}
+	if command := strings.TrimSpace(line); command != "" {
+		e.fromInput = append(e.fromInput, Command{Time: t, Command: command})
+	}
+}
+
+// commandLine joins the rows from the prompt to the cursor, long command
+// lines wrap.
+func (e *commandExtractor) commandLine() string {
+	_, y := e.screen.Cursor()
+	start := e.promptRow - e.screen.Scrolled()
+	if start < 0 || start > y {
+		start = y
+	}
+	var sb strings.Builder
+	for row := start; row <= y; row++ {
+		line := e.screen.Line(row)
+		sb.WriteString(line)
+		if row < y && len([]rune(line)) < e.screen.Cols {
+			break
+		}
+	}
+	return sb.String()
+}
+
+func (e *commandExtractor) checkPrompt(t float64) {
+	if e.sawInput || e.prompt == nil || e.screen.AltScreen() {
+		return
+	}
+	_, y := e.screen.Cursor()
+	line := e.screen.Line(y)
+	loc := e.prompt.FindStringIndex(line)
+	if loc == nil {
+		return
+	}
+	if command := strings.TrimSpace(line[loc[1]:]); command != "" {
+		e.fromOutput = append(e.fromOutput, Command{Time: t, Command: command})
+	}
+}
@@ -0,0 +1,134 @@
+package term
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"strings"
+)
+
+//go:embed player.html
+var playerHtml string
+
+// WriteTranscript renders an asciicast v2 recording as plain text. Output is
+// replayed on a Screen, so a line appears as it was finally shown, after
+// cursor movement, erasing and line editing. Full screen programs on the
+// alternate screen are left out. Lines are written as soon as they leave the
+// screen, the recording is never held in memory.
+func WriteTranscript(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	var werr error
+	screen, err := replayRecording(r, func(screen *Screen) {
+		screen.OnScroll = func(line string) {
+			if werr == nil {
+				_, werr = bw.WriteString(line + "\n")
+			}
+		}
+	}, func() error {
+		return werr
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range screen.Lines() {
+		if _, err := bw.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// replayRecording replays the "o" and "r" events of an asciicast recording
+// on a screen set up by init, stopping when after returns an error.
+func replayRecording(r io.Reader, init func(screen *Screen), after func() error) (*Screen, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, errors.New("not an asciicast recording")
+	}
+	screen := NewScreen(header.Width, header.Height)
+	init(screen)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var event []interface{}
+			if json.Unmarshal(line, &event) == nil && len(event) == 3 {
+				code, _ := event[1].(string)
+				data, _ := event[2].(string)
+				switch code {
+				case "o":
+					screen.Write(data)
+				case "r":
+					if cols, rows, ok := ParseSize(data); ok {
+						screen.Resize(cols, rows)
+					}
+				}
+				if err := after(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return screen, nil
+}
+
+// WriteHtml writes a single HTML file playing the asciicast v2 recording
+// without any external resources. The recording is copied through as it is
+// read and commands, when given, are shown on the timeline.
+func WriteHtml(w io.Writer, r io.Reader, title string, commands []Command) error {
+	if commands == nil {
+		commands = make([]Command, 0)
+	}
+	p, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+	head, tail, ok := strings.Cut(playerHtml, "%EVENTS%")
+	if !ok {
+		return errors.New("invalid player template")
+	}
+	head = strings.ReplaceAll(head, "%TITLE%", html.EscapeString(title))
+	tail = strings.ReplaceAll(tail, "%COMMANDS%", string(p))
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(head); err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			// Keep the recording from closing the script element, "<" only
+			// occurs inside JSON strings
+			line = bytes.ReplaceAll(line, []byte("<"), []byte(`\u003c`))
+			if _, err := bw.Write(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := bw.WriteString(tail); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
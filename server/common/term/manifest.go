@@ -0,0 +1,339 @@
+package term
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const RecordingManifestName = "manifest.json"
+
+// RecordingMetaName is the session metadata stored next to a recording, its
+// hash is part of the signed manifest.
+const RecordingMetaName = "meta.json"
+
+// ManifestSegment is the hash of the uncompressed content of a segment and
+// the chain hash up to and including it.
+type ManifestSegment struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Chain  string `json:"chain"`
+}
+
+// Manifest makes a recording tamper-evident. Every chain hash is
+// SHA-256(previous chain || name || segment hash), so removing, reordering or
+// editing a segment breaks the chain, and the signature covers all of it.
+// Files are the hashes of the other files of a recording by name, such as
+// those of guacd recordings and their keystroke logs.
+type Manifest struct {
+	Version   int               `json:"version"`
+	Algorithm string            `json:"algorithm"`
+	Segments  []ManifestSegment `json:"segments"`
+	Chain     string            `json:"chain"`
+	Meta      string            `json:"meta,omitempty"`
+	Files     map[string]string `json:"files,omitempty"`
+	Complete  bool              `json:"complete"`
+	PublicKey string            `json:"publicKey,omitempty"`
+	Signature string            `json:"signature,omitempty"`
+}
+
+func newManifest() Manifest {
+	return Manifest{Version: 1, Algorithm: "sha256", Segments: make([]ManifestSegment, 0)}
+}
+
+func chainHash(previous, name, sum string) string {
+	h := sha256.New()
+	h.Write([]byte(previous))
+	h.Write([]byte(name))
+	h.Write([]byte(sum))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (m *Manifest) add(name, sum string) {
+	m.Chain = chainHash(m.Chain, name, sum)
+	m.Segments = append(m.Segments, ManifestSegment{Name: name, SHA256: sum, Chain: m.Chain})
+}
+
+// signedBytes is the manifest without its signature, the message that is signed.
+func (m Manifest) signedBytes() ([]byte, error) {
+	m.Signature = ""
+	return json.Marshal(m)
+}
+
+func (m *Manifest) sign(key ed25519.PrivateKey) error {
+	m.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	p, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, p))
+	return nil
+}
+
+// SealRecording writes the complete manifest of a recording not written by
+// a Recorder, covering the files of dir that exist and the metadata. It is
+// signed when key is given.
+func SealRecording(dir string, files []string, key ed25519.PrivateKey) error {
+	manifest := newManifest()
+	manifest.Complete = true
+	for _, name := range files {
+		sum, err := hashFile(path.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if manifest.Files == nil {
+			manifest.Files = make(map[string]string)
+		}
+		manifest.Files[name] = sum
+	}
+	if sum, err := hashFile(path.Join(dir, RecordingMetaName)); err == nil {
+		manifest.Meta = sum
+	}
+	if key != nil {
+		if err := manifest.sign(key); err != nil {
+			return err
+		}
+	}
+	return writeManifest(dir, manifest)
+}
+
+func writeManifest(dir string, manifest Manifest) error {
+	p, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, RecordingManifestName+".tmp")
+	if err := os.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, RecordingManifestName))
+}
+
+func ReadManifest(dir string) (*Manifest, error) {
+	p, err := os.ReadFile(path.Join(dir, RecordingManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verification is the result of checking a recording against its manifest.
+type Verification struct {
+	Valid bool `json:"valid"`
+	// Signed is set when the manifest carries a signature, Trusted when it
+	// was made by the expected key.
+	Signed   bool     `json:"signed"`
+	Trusted  bool     `json:"trusted"`
+	Complete bool     `json:"complete"`
+	Segments int      `json:"segments"`
+	Files    int      `json:"files"`
+	Problems []string `json:"problems"`
+}
+
+func (v *Verification) problem(format string, args ...interface{}) {
+	v.Valid = false
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyRecording recomputes the hashes of the recording in dir. The
+// signature is checked against key when given, otherwise against the key in
+// the manifest, which only proves the manifest is intact.
+func VerifyRecording(dir string, key ed25519.PublicKey) (*Verification, error) {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	v := &Verification{Valid: true, Complete: manifest.Complete, Segments: len(manifest.Segments), Files: len(manifest.Files), Problems: make([]string, 0)}
+
+	chain := ""
+	for i, segment := range manifest.Segments {
+		chain = chainHash(chain, segment.Name, segment.SHA256)
+		if chain != segment.Chain {
+			v.problem("segment %d (%s): chain hash mismatch", i+1, segment.Name)
+		}
+		r, err := OpenSegment(dir, Segment{Name: segment.Name})
+		if err != nil {
+			v.problem("segment %d (%s): %v", i+1, segment.Name, err)
+			continue
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		_ = r.Close()
+		if err != nil {
+			v.problem("segment %d (%s): %v", i+1, segment.Name, err)
+			continue
+		}
+		if hex.EncodeToString(h.Sum(nil)) != segment.SHA256 {
+			v.problem("segment %d (%s): content modified", i+1, segment.Name)
+		}
+	}
+	if chain != manifest.Chain {
+		v.problem("manifest chain hash mismatch")
+	}
+
+	// Segments missing from the manifest were added or not closed properly
+	if index, err := ReadIndex(dir); err == nil {
+		for i, segment := range index.Segments {
+			name := strings.TrimSuffix(segment.Name, ".gz")
+			if i >= len(manifest.Segments) {
+				if segment.Closed || manifest.Complete {
+					v.problem("segment %s is not in the manifest", name)
+				}
+				continue
+			}
+			if manifest.Segments[i].Name != name {
+				v.problem("segment %d: index lists %s, manifest %s", i+1, name, manifest.Segments[i].Name)
+			}
+		}
+		if len(index.Segments) < len(manifest.Segments) {
+			v.problem("index lists %d segments, manifest %d", len(index.Segments), len(manifest.Segments))
+		}
+	}
+
+	if manifest.Meta != "" {
+		sum, err := hashFile(path.Join(dir, RecordingMetaName))
+		if err != nil {
+			v.problem("%s: %v", RecordingMetaName, err)
+		} else if sum != manifest.Meta {
+			v.problem("%s modified", RecordingMetaName)
+		}
+	}
+
+	names := make([]string, 0, len(manifest.Files))
+	for name := range manifest.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if path.Base(name) != name {
+			v.problem("%s: invalid file name", name)
+			continue
+		}
+		sum, err := hashFile(path.Join(dir, name))
+		if err != nil {
+			v.problem("%s: %v", name, err)
+		} else if sum != manifest.Files[name] {
+			v.problem("%s modified", name)
+		}
+	}
+
+	if manifest.Signature == "" {
+		if key != nil {
+			v.problem("manifest is not signed")
+		}
+		return v, nil
+	}
+	v.Signed = true
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		v.problem("invalid signature encoding")
+		return v, nil
+	}
+	signer := key
+	if signer == nil {
+		p, err := base64.StdEncoding.DecodeString(manifest.PublicKey)
+		if err != nil || len(p) != ed25519.PublicKeySize {
+			v.problem("invalid public key in manifest")
+			return v, nil
+		}
+		signer = p
+	}
+	p, err := manifest.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(signer, p, signature) {
+		v.problem("signature mismatch")
+		return v, nil
+	}
+	v.Trusted = key != nil
+	return v, nil
+}
+
+// LoadSigningKey reads a PEM encoded PKCS #8 Ed25519 private key, as written
+// by `openssl genpkey -algorithm ed25519`.
+func LoadSigningKey(file string) (ed25519.PrivateKey, error) {
+	block, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+// LoadVerifyKey reads a PEM encoded Ed25519 public key, or derives it from a
+// private key.
+func LoadVerifyKey(file string) (ed25519.PublicKey, error) {
+	block, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.PublicKey
+	if block.Type == "PRIVATE KEY" {
+		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := privateKey.(crypto.Signer); ok {
+			key = signer.Public()
+		}
+	} else if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 key")
+	}
+	return publicKey, nil
+}
+
+func readPem(file string) (*pem.Block, error) {
+	p, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(p)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	return block, nil
+}
@@ -0,0 +1,328 @@
+package term
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newTestRecording records a session of three segments, one per event, in a
+// new directory, signed with key when it is given.
+func newTestRecording(t *testing.T, key ed25519.PrivateKey) string {
+	t.Helper()
+	dir := path.Join(t.TempDir(), "recording")
+	recorder, err := NewRecorderWithHeader(dir, &Header{Width: 80, Height: 24}, RecorderOptions{SegmentSize: 1, SigningKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, RecordingMetaName), []byte(`{"sessionId":"s1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := recorder.WriteData(fmt.Sprintf("line %d of the session\r\n", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Segments) != 3 {
+		t.Fatalf("recorded %d segments, want 3", len(manifest.Segments))
+	}
+	return dir
+}
+
+func editManifest(t *testing.T, dir string, edit func(m *Manifest)) {
+	t.Helper()
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(manifest)
+	if err := writeManifest(dir, *manifest); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, name, data string) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRecording(t *testing.T) {
+	key := newTestKey(t)
+	public := key.Public().(ed25519.PublicKey)
+	other := newTestKey(t)
+
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, dir string)
+		// unsigned records without a key
+		unsigned bool
+		// key the signature is checked against, nil trusts the manifest
+		key     ed25519.PublicKey
+		problem string
+		trusted bool
+	}{
+		{
+			name:    "intact",
+			tamper:  func(t *testing.T, dir string) {},
+			key:     public,
+			trusted: true,
+		},
+		{
+			name:   "intact without a trusted key",
+			tamper: func(t *testing.T, dir string) {},
+		},
+		{
+			name: "segment modified",
+			tamper: func(t *testing.T, dir string) {
+				appendFile(t, path.Join(dir, "segment-000002.cast"), `[9.9, "o", "rm -rf /"]`+"\n")
+			},
+			key:     public,
+			problem: "segment 2 (segment-000002.cast): content modified",
+		},
+		{
+			name: "segment removed",
+			tamper: func(t *testing.T, dir string) {
+				if err := os.Remove(path.Join(dir, "segment-000003.cast")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			key:     public,
+			problem: "segment 3 (segment-000003.cast):",
+		},
+		{
+			name: "segment removed from the manifest",
+			tamper: func(t *testing.T, dir string) {
+				editManifest(t, dir, func(m *Manifest) {
+					m.Segments = m.Segments[:2]
+					m.Chain = m.Segments[1].Chain
+				})
+			},
+			key:     public,
+			problem: "segment segment-000003.cast is not in the manifest",
+		},
+		{
+			name: "segments reordered",
+			tamper: func(t *testing.T, dir string) {
+				editManifest(t, dir, func(m *Manifest) {
+					m.Segments[0], m.Segments[1] = m.Segments[1], m.Segments[0]
+				})
+			},
+			key:     public,
+			problem: "chain hash mismatch",
+		},
+		{
+			name: "chain recomputed without the key",
+			tamper: func(t *testing.T, dir string) {
+				appendFile(t, path.Join(dir, "segment-000001.cast"), `[0.5, "o", "injected"]`+"\n")
+				editManifest(t, dir, func(m *Manifest) {
+					sum, err := hashFile(path.Join(dir, "segment-000001.cast"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					segments := m.Segments
+					m.Segments, m.Chain = nil, ""
+					for _, segment := range segments {
+						if segment.Name == "segment-000001.cast" {
+							segment.SHA256 = sum
+						}
+						m.add(segment.Name, segment.SHA256)
+					}
+				})
+			},
+			key:     public,
+			problem: "signature mismatch",
+		},
+		{
+			name: "metadata modified",
+			tamper: func(t *testing.T, dir string) {
+				if err := os.WriteFile(path.Join(dir, RecordingMetaName), []byte(`{"sessionId":"s2"}`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			key:     public,
+			problem: "meta.json modified",
+		},
+		{
+			name: "signed by another key",
+			tamper: func(t *testing.T, dir string) {
+				editManifest(t, dir, func(m *Manifest) {
+					if err := m.sign(other); err != nil {
+						t.Fatal(err)
+					}
+				})
+			},
+			key:     public,
+			problem: "signature mismatch",
+		},
+		{
+			name: "signature removed",
+			tamper: func(t *testing.T, dir string) {
+				editManifest(t, dir, func(m *Manifest) {
+					m.PublicKey, m.Signature = "", ""
+				})
+			},
+			key:     public,
+			problem: "manifest is not signed",
+		},
+		{
+			name:     "unsigned",
+			tamper:   func(t *testing.T, dir string) {},
+			unsigned: true,
+			key:      public,
+			problem:  "manifest is not signed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signingKey := key
+			if tt.unsigned {
+				signingKey = nil
+			}
+			dir := newTestRecording(t, signingKey)
+			tt.tamper(t, dir)
+			v, err := VerifyRecording(dir, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.problem == "" {
+				if !v.Valid {
+					t.Fatalf("problems %q, want none", v.Problems)
+				}
+				if v.Trusted != tt.trusted || !v.Complete || v.Segments != 3 {
+					t.Errorf("got %+v", v)
+				}
+				return
+			}
+			if v.Valid {
+				t.Errorf("tampered recording verified: %+v", v)
+			}
+			if !strings.Contains(strings.Join(v.Problems, "\n"), tt.problem) {
+				t.Errorf("problems %q, want %q", v.Problems, tt.problem)
+			}
+		})
+	}
+}
+
+func TestSealRecording(t *testing.T) {
+	key := newTestKey(t)
+	public := key.Public().(ed25519.PublicKey)
+	files := []string{"recording.guac", "keys.log"}
+
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, dir string)
+		problem string
+	}{
+		{
+			name:   "intact",
+			tamper: func(t *testing.T, dir string) {},
+		},
+		{
+			name: "keystroke log modified",
+			tamper: func(t *testing.T, dir string) {
+				if err := os.WriteFile(path.Join(dir, "keys.log"), []byte("0.500 keys ls\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: "keys.log modified",
+		},
+		{
+			name: "keystroke log removed",
+			tamper: func(t *testing.T, dir string) {
+				if err := os.Remove(path.Join(dir, "keys.log")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: "keys.log:",
+		},
+		{
+			name: "recording truncated",
+			tamper: func(t *testing.T, dir string) {
+				if err := os.Truncate(path.Join(dir, "recording.guac"), 4); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: "recording.guac modified",
+		},
+		{
+			name: "file dropped from the manifest",
+			tamper: func(t *testing.T, dir string) {
+				editManifest(t, dir, func(m *Manifest) {
+					delete(m.Files, "keys.log")
+				})
+			},
+			problem: "signature mismatch",
+		},
+		{
+			name: "file outside of the recording",
+			tamper: func(t *testing.T, dir string) {
+				editManifest(t, dir, func(m *Manifest) {
+					m.Files["../keys.log"] = m.Files["keys.log"]
+				})
+			},
+			problem: "../keys.log: invalid file name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range map[string]string{
+				"recording.guac":  "4.sync,4.1000;",
+				"keys.log":        "0.500 keys [REDACTED]<Enter>\n",
+				RecordingMetaName: `{"sessionId":"s1"}`,
+			} {
+				if err := os.WriteFile(path.Join(dir, name), []byte(data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Files that do not exist are skipped
+			if err := SealRecording(dir, append(files, "missing.log"), key); err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(t, dir)
+			v, err := VerifyRecording(dir, public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.problem == "" {
+				if !v.Valid || !v.Trusted || v.Files != 2 {
+					t.Errorf("got %+v", v)
+				}
+				return
+			}
+			if v.Valid {
+				t.Errorf("tampered recording verified: %+v", v)
+			}
+			if !strings.Contains(strings.Join(v.Problems, "\n"), tt.problem) {
+				t.Errorf("problems %q, want %q", v.Problems, tt.problem)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -16,6 +17,11 @@ type QuickTerminal struct {
 	SftpClient   *sftp.Client
 	Recorder     *Recorder
 	StdoutReader *bufio.Reader
+
+	// parent is set on additional shell channels opened on an existing
+	// connection; such channels never own SshClient.
+	parent   *QuickTerminal
+	channels sync.Map
 }
 
 func NewQuickTerminal(ip string, port int, username, password, privateKey, passphrase string, rows, cols int, recording, term string, pipe bool) (*QuickTerminal, error) {
@@ -76,6 +82,37 @@ func newNT(sshClient *ssh.Client, pipe bool, recording string, term string, rows
 	return &terminal, nil
 }
 
+// OpenChannel opens an additional shell channel on the SSH connection of ret,
+// so a new terminal can be attached without repeating the login.
+func (ret *QuickTerminal) OpenChannel(recording, term string, rows, cols int) (*QuickTerminal, error) {
+	if ret.parent != nil {
+		return ret.parent.OpenChannel(recording, term, rows, cols)
+	}
+	channel, err := newNT(ret.SshClient, true, "", term, rows, cols)
+	if err != nil {
+		return nil, err
+	}
+	if recording != "" {
+		header := &Header{Height: rows, Width: cols, Env: Env{Shell: DefaultShell, Term: term}}
+		if ret.Recorder != nil && ret.Recorder.Header != nil {
+			header.Title = ret.Recorder.Header.Title
+			header.Env.Shell = ret.Recorder.Header.Env.Shell
+		}
+		var options RecorderOptions
+		if ret.Recorder != nil {
+			options = ret.Recorder.Options()
+		}
+		channel.Recorder, err = NewRecorderWithHeader(recording, header, options)
+		if err != nil {
+			_ = channel.SshSession.Close()
+			return nil, err
+		}
+	}
+	channel.parent = ret
+	ret.channels.Store(channel, struct{}{})
+	return channel, nil
+}
+
 func (ret *QuickTerminal) Write(p []byte) (int, error) {
 	if ret.StdinPipe == nil {
 		return 0, errors.New("pipe is not open")
@@ -85,6 +122,23 @@ func (ret *QuickTerminal) Write(p []byte) (int, error) {
 
 func (ret *QuickTerminal) Close() {
 
+	if ret.parent != nil {
+		// A channel only releases its own shell, the connection stays with the parent
+		ret.parent.channels.Delete(ret)
+		if ret.SshSession != nil {
+			_ = ret.SshSession.Close()
+		}
+		if ret.Recorder != nil {
+			_ = ret.Recorder.Close()
+		}
+		return
+	}
+
+	ret.channels.Range(func(key, value interface{}) bool {
+		key.(*QuickTerminal).Close()
+		return true
+	})
+
 	if ret.SftpClient != nil {
 		_ = ret.SftpClient.Close()
 	}
@@ -98,7 +152,7 @@ func (ret *QuickTerminal) Close() {
 	}
 
 	if ret.Recorder != nil {
-		ret.Recorder.Close()
+		_ = ret.Recorder.Close()
 	}
 }
 
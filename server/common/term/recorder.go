@@ -1,13 +1,24 @@
 package term
 
 import (
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
 	"os"
+	"path"
+	"sync"
 	"time"
-
-	"quick-terminal/server/utils"
 )
 
+// DefaultShell is recorded as the shell of SSH sessions, asking the remote
+// for it would run a command the target audits on every connect.
+const DefaultShell = "/bin/bash"
+
 type Env struct {
 	Shell string `json:"SHELL"`
 	Term  string `json:"TERM"`
@@ -19,95 +30,375 @@ type Header struct {
 	Height    int    `json:"height"`
 	Width     int    `json:"width"`
 	Env       Env    `json:"env"`
-	Timestamp int    `json:"Timestamp"`
+	Timestamp int    `json:"timestamp"`
+}
+
+// RecorderOptions control how a recording is split into segments, zero
+// values disable the respective limit.
+type RecorderOptions struct {
+	SegmentSize     int64 // bytes
+	SegmentDuration time.Duration
+	Compress        bool
+	// SigningKey signs the manifest when the recording is closed
+	SigningKey ed25519.PrivateKey
+}
+
+const RecordingIndexName = "index.json"
+
+// Segment is a part of a recording. Every segment is a complete asciicast
+// file, event times are relative to the start of the whole recording.
+type Segment struct {
+	Name   string  `json:"name"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+	Size   int64   `json:"size"`
+	Closed bool    `json:"closed"`
+}
+
+// Index lists the segments of a recording in order.
+type Index struct {
+	Version  int       `json:"version"`
+	Format   string    `json:"format"`
+	Segments []Segment `json:"segments"`
+}
+
+// activeRecordings holds the directories of recordings still being written.
+var activeRecordings sync.Map
+
+// IsActive reports whether the recording in dir is still being written.
+func IsActive(dir string) bool {
+	_, ok := activeRecordings.Load(path.Clean(dir))
+	return ok
 }
 
 type Recorder struct {
-	File      *os.File
-	Timestamp int
+	Dir     string
+	Header  *Header
+	options RecorderOptions
+	index   Index
+	file    *os.File
+	// hash covers the uncompressed content of the current segment
+	hash     hash.Hash
+	manifest Manifest
+	// segmentStart is when the current segment was opened
+	segmentStart time.Time
+	// segmentEvents counts the events in the current segment
+	segmentEvents int
+	// start carries the monotonic clock reading event times are measured against
+	start time.Time
+	mutex sync.Mutex
+	// redactor is set when input events are recorded
+	redactor    *Redactor
+	compressing sync.WaitGroup
+	closed      bool
 }
 
-func (recorder *Recorder) Close() {
-	if recorder.File != nil {
-		_ = recorder.File.Close()
-	}
+// RecordInput enables "i" events, filtered through redactor.
+func (recorder *Recorder) RecordInput(redactor *Redactor) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.redactor = redactor
 }
 
-func (recorder *Recorder) WriteHeader(header *Header) (err error) {
-	var p []byte
+func (recorder *Recorder) Options() RecorderOptions {
+	return recorder.options
+}
 
-	if p, err = json.Marshal(header); err != nil {
-		return
+// Close ends the recording and seals its manifest.
+func (recorder *Recorder) Close() error {
+	recorder.mutex.Lock()
+	if recorder.closed {
+		recorder.mutex.Unlock()
+		return nil
 	}
-
-	if _, err := recorder.File.Write(p); err != nil {
-		return err
+	recorder.closed = true
+	if recorder.redactor != nil {
+		for _, event := range recorder.redactor.Flush() {
+			_ = recorder.writeEvent(event.Time, "i", event.Data)
+		}
 	}
-	if _, err := recorder.File.Write([]byte("\n")); err != nil {
-		return err
+	err := recorder.closeSegment()
+	if e := recorder.finishManifest(); err == nil {
+		err = e
 	}
+	recorder.mutex.Unlock()
 
-	recorder.Timestamp = header.Timestamp
-
-	return
+	// Wait for the last segments to be compressed
+	recorder.compressing.Wait()
+	activeRecordings.Delete(path.Clean(recorder.Dir))
+	return err
 }
 
 func (recorder *Recorder) WriteData(data string) (err error) {
-	now := int(time.Now().UnixNano())
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.redactor != nil {
+		for _, event := range recorder.redactor.Output(data) {
+			if err := recorder.writeEvent(event.Time, "i", event.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return recorder.writeEvent(time.Now(), "o", data)
+}
 
-	delta := float64(now-recorder.Timestamp*1000*1000*1000) / 1000 / 1000 / 1000
+// WriteResize records a terminal size change as an "r" event.
+func (recorder *Recorder) WriteResize(cols, rows int) (err error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return recorder.writeEvent(time.Now(), "r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// WriteInput records user input, it is a no-op unless RecordInput was called.
+func (recorder *Recorder) WriteInput(data string) (err error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.redactor == nil {
+		return nil
+	}
+	for _, event := range recorder.redactor.Input(time.Now(), data) {
+		if err := recorder.writeEvent(event.Time, "i", event.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMarker records an asciicast "m" event, players show label on the
+// timeline.
+func (recorder *Recorder) WriteMarker(label string) (err error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return recorder.writeEvent(time.Now(), "m", label)
+}
+
+func (recorder *Recorder) writeEvent(t time.Time, code, data string) (err error) {
+	if recorder.file == nil {
+		return os.ErrClosed
+	}
+	delta := t.Sub(recorder.start).Seconds()
+	if delta < 0 {
+		delta = 0
+	}
 
 	row := make([]interface{}, 0)
 	row = append(row, delta)
-	row = append(row, "o")
+	row = append(row, code)
 	row = append(row, data)
 
 	var s []byte
 	if s, err = json.Marshal(row); err != nil {
 		return
 	}
-	if _, err := recorder.File.Write(s); err != nil {
-		return err
+	s = append(s, '\n')
+
+	if recorder.shouldRotate(t, int64(len(s))) {
+		if err := recorder.closeSegment(); err != nil {
+			return err
+		}
+		if err := recorder.openSegment(delta); err != nil {
+			return err
+		}
 	}
-	if _, err := recorder.File.Write([]byte("\n")); err != nil {
+
+	if _, err := recorder.file.Write(s); err != nil {
 		return err
 	}
+	recorder.hash.Write(s)
+	recorder.segmentEvents++
+	segment := &recorder.index.Segments[len(recorder.index.Segments)-1]
+	segment.Size += int64(len(s))
+	segment.End = delta
 	return
 }
 
-func NewRecorder(recordingPath, term string, h int, w int) (recorder *Recorder, err error) {
-	recorder = &Recorder{}
-	parentDirectory := utils.GetParentDirectory(recordingPath)
-	if utils.FileExists(parentDirectory) {
-		if err := os.RemoveAll(parentDirectory); err != nil {
-			return nil, err
-		}
+func (recorder *Recorder) shouldRotate(t time.Time, size int64) bool {
+	if recorder.segmentEvents == 0 {
+		return false
+	}
+	segment := recorder.index.Segments[len(recorder.index.Segments)-1]
+	if recorder.options.SegmentSize > 0 && segment.Size+size > recorder.options.SegmentSize {
+		return true
 	}
+	if recorder.options.SegmentDuration > 0 && t.Sub(recorder.segmentStart) >= recorder.options.SegmentDuration {
+		return true
+	}
+	return false
+}
 
-	if err = os.MkdirAll(parentDirectory, 0777); err != nil {
+// openSegment starts a new segment file with a copy of the header.
+func (recorder *Recorder) openSegment(start float64) error {
+	name := fmt.Sprintf("segment-%06d.cast", len(recorder.index.Segments)+1)
+	file, err := os.OpenFile(path.Join(recorder.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	p, err := json.Marshal(recorder.Header)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	p = append(p, '\n')
+	if _, err := file.Write(p); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	recorder.file = file
+	recorder.hash = sha256.New()
+	recorder.hash.Write(p)
+	recorder.segmentStart = time.Now()
+	recorder.segmentEvents = 0
+	recorder.index.Segments = append(recorder.index.Segments, Segment{
+		Name:  name,
+		Start: start,
+		End:   start,
+		Size:  int64(len(p)),
+	})
+	return recorder.writeIndex()
+}
+
+// closeSegment closes the current segment and compresses it in the background.
+func (recorder *Recorder) closeSegment() error {
+	if recorder.file == nil {
+		return nil
+	}
+	err := recorder.file.Close()
+	recorder.file = nil
+	i := len(recorder.index.Segments) - 1
+	recorder.index.Segments[i].Closed = true
+	if err != nil {
+		return err
+	}
+	recorder.manifest.add(recorder.index.Segments[i].Name, hex.EncodeToString(recorder.hash.Sum(nil)))
+	if err := writeManifest(recorder.Dir, recorder.manifest); err != nil {
+		return err
+	}
+	if err := recorder.writeIndex(); err != nil {
+		return err
+	}
+	if recorder.options.Compress {
+		recorder.compressing.Add(1)
+		go recorder.compressSegment(i)
+	}
+	return nil
+}
+
+func (recorder *Recorder) compressSegment(i int) {
+	defer recorder.compressing.Done()
+
+	recorder.mutex.Lock()
+	name := recorder.index.Segments[i].Name
+	recorder.mutex.Unlock()
+
+	size, err := gzipFile(path.Join(recorder.Dir, name))
+	if err != nil {
 		return
 	}
 
-	var file *os.File
-	file, err = os.Create(recordingPath)
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.index.Segments[i].Name = name + ".gz"
+	recorder.index.Segments[i].Size = size
+	if err := recorder.writeIndex(); err == nil {
+		_ = os.Remove(path.Join(recorder.Dir, name))
+	}
+}
+
+// finishManifest seals the manifest of a closed recording, signing it when
+// a key is configured.
+func (recorder *Recorder) finishManifest() error {
+	recorder.manifest.Complete = true
+	if sum, err := hashFile(path.Join(recorder.Dir, RecordingMetaName)); err == nil {
+		recorder.manifest.Meta = sum
+	}
+	if recorder.options.SigningKey != nil {
+		if err := recorder.manifest.sign(recorder.options.SigningKey); err != nil {
+			return err
+		}
+	}
+	return writeManifest(recorder.Dir, recorder.manifest)
+}
+
+// writeIndex replaces the index file atomically.
+func (recorder *Recorder) writeIndex() error {
+	p, err := json.Marshal(recorder.index)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	tmp := path.Join(recorder.Dir, RecordingIndexName+".tmp")
+	if err := os.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(recorder.Dir, RecordingIndexName))
+}
 
-	recorder.File = file
+func gzipFile(name string) (int64, error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
 
-	header := &Header{
-		Title:     "",
-		Version:   2,
-		Height:    h,
-		Width:     w,
-		Env:       Env{Shell: "/bin/bash", Term: term},
-		Timestamp: int(time.Now().Unix()),
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		return 0, err
 	}
+	if err := zw.Close(); err != nil {
+		_ = dst.Close()
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(name + ".gz")
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func NewRecorder(dir, term string, h int, w int) (recorder *Recorder, err error) {
+	return NewRecorderWithHeader(dir, &Header{
+		Title:  "",
+		Height: h,
+		Width:  w,
+		Env:    Env{Shell: "/bin/bash", Term: term},
+	}, RecorderOptions{})
+}
+
+// NewRecorderWithHeader creates a segmented asciicast v2 recording in dir,
+// which must not exist yet. The version and timestamp of header are filled in.
+func NewRecorderWithHeader(dir string, header *Header, options RecorderOptions) (recorder *Recorder, err error) {
+	if err = os.MkdirAll(path.Dir(dir), 0777); err != nil {
+		return nil, err
+	}
+	// Never reuse a directory, earlier recordings are evidence
+	if err = os.Mkdir(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	recorder = &Recorder{
+		Dir:      dir,
+		Header:   header,
+		options:  options,
+		index:    Index{Version: 1, Format: "asciicast"},
+		manifest: newManifest(),
+		start:    time.Now(),
+	}
+
+	header.Version = 2
+	header.Timestamp = int(recorder.start.Unix())
 
-	if err := recorder.WriteHeader(header); err != nil {
+	if err := recorder.openSegment(0); err != nil {
 		return nil, err
 	}
+	activeRecordings.Store(path.Clean(dir), struct{}{})
 
 	return recorder, nil
 }
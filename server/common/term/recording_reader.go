@@ -0,0 +1,95 @@
+package term
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ReadIndex reads the segment index of the recording in dir.
+func ReadIndex(dir string) (*Index, error) {
+	p, err := os.ReadFile(path.Join(dir, RecordingIndexName))
+	if err != nil {
+		return nil, err
+	}
+	var index Index
+	if err := json.Unmarshal(p, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// OpenSegment opens a segment for reading, decompressing it if needed.
+func OpenSegment(dir string, segment Segment) (io.ReadCloser, error) {
+	file, err := os.Open(path.Join(dir, segment.Name))
+	if os.IsNotExist(err) && !strings.HasSuffix(segment.Name, ".gz") {
+		// The segment was compressed after the index was read
+		segment.Name += ".gz"
+		file, err = os.Open(path.Join(dir, segment.Name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(segment.Name, ".gz") {
+		return file, nil
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &gzipFileReader{Reader: zr, file: file}, nil
+}
+
+type gzipFileReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipFileReader) Close() error {
+	_ = r.Reader.Close()
+	return r.file.Close()
+}
+
+// OpenRecording returns the segments of the recording in dir as a single
+// asciicast stream, the header is only taken from the first segment.
+func OpenRecording(dir string) (io.ReadCloser, error) {
+	index, err := ReadIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copySegments(pw, dir, index.Segments))
+	}()
+	return pr, nil
+}
+
+func copySegments(w io.Writer, dir string, segments []Segment) error {
+	for i, segment := range segments {
+		r, err := OpenSegment(dir, segment)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReaderSize(r, 64*1024)
+		if i > 0 {
+			if _, err := reader.ReadBytes('\n'); err != nil {
+				_ = r.Close()
+				if err == io.EOF {
+					continue
+				}
+				return err
+			}
+		}
+		_, err = io.Copy(w, reader)
+		_ = r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package term
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultRedactionMarker replaces input that looks like a secret.
+const DefaultRedactionMarker = "[REDACTED]"
+
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|O[@-~]|[@-Z\\-_])`)
+
+type InputEvent struct {
+	Time time.Time
+	Data string
+}
+
+// Redactor decides which input events may be recorded. Input typed after an
+// output line matching one of Prompts is redacted, and with NoEcho input is
+// held back until the next output shows whether the terminal echoed it.
+// Redaction lasts until the next Enter.
+type Redactor struct {
+	Prompts []*regexp.Regexp
+	NoEcho  bool
+	Marker  string
+
+	line      string
+	pending   []InputEvent
+	redacting bool
+}
+
+func NewRedactor(prompts []string, noEcho bool, marker string) (*Redactor, error) {
+	redactor := &Redactor{
+		NoEcho: noEcho,
+		Marker: marker,
+	}
+	if redactor.Marker == "" {
+		redactor.Marker = DefaultRedactionMarker
+	}
+	for _, prompt := range prompts {
+		re, err := regexp.Compile(prompt)
+		if err != nil {
+			return nil, err
+		}
+		redactor.Prompts = append(redactor.Prompts, re)
+	}
+	return redactor, nil
+}
+
+// Input returns the events that can be recorded right away.
+func (r *Redactor) Input(t time.Time, data string) []InputEvent {
+	if r.redacting {
+		r.redacting = !hasEnter(data)
+		return nil
+	}
+	if r.atPrompt() {
+		r.redacting = !hasEnter(data)
+		return []InputEvent{{Time: t, Data: r.Marker}}
+	}
+	// Keys sending escape sequences, such as the cursor keys, are not echoed
+	if len(r.pending) > 0 || (r.NoEcho && hasPrintable(ansiEscape.ReplaceAllString(data, ""))) {
+		r.pending = append(r.pending, InputEvent{Time: t, Data: data})
+		return nil
+	}
+	return []InputEvent{{Time: t, Data: data}}
+}
+
+// Output tracks the current output line and returns the held back input
+// events, which must be recorded before data.
+func (r *Redactor) Output(data string) []InputEvent {
+	text := ansiEscape.ReplaceAllString(data, "")
+
+	var events []InputEvent
+	if len(r.pending) > 0 {
+		if echoed(r.pending, text) {
+			events = r.pending
+		} else {
+			events = []InputEvent{{Time: r.pending[0].Time, Data: r.Marker}}
+			r.redacting = !hasEnter(r.pending[len(r.pending)-1].Data)
+		}
+		r.pending = nil
+	}
+
+	if i := strings.LastIndexAny(text, "\r\n"); i >= 0 {
+		r.line = text[i+1:]
+	} else {
+		r.line += text
+	}
+	if len(r.line) > 256 {
+		r.line = r.line[len(r.line)-256:]
+	}
+	return events
+}
+
+// Flush returns the held back input when the recording ends, unconfirmed
+// input is redacted.
+func (r *Redactor) Flush() []InputEvent {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	events := []InputEvent{{Time: r.pending[0].Time, Data: r.Marker}}
+	r.pending = nil
+	return events
+}
+
+func (r *Redactor) atPrompt() bool {
+	for _, prompt := range r.Prompts {
+		if prompt.MatchString(r.line) {
+			return true
+		}
+	}
+	return false
+}
+
+// echoed reports whether output begins with the printable characters of
+// the input events, in order. Output echoing only part of the input, or
+// anything else, is taken as not echoed so that the input is redacted.
+func echoed(events []InputEvent, output string) bool {
+	var input strings.Builder
+	for _, event := range events {
+		for _, c := range ansiEscape.ReplaceAllString(event.Data, "") {
+			if unicode.IsPrint(c) {
+				input.WriteRune(c)
+			}
+		}
+	}
+	return strings.HasPrefix(output, input.String())
+}
+
+func hasEnter(data string) bool {
+	return strings.ContainsAny(data, "\r\n")
+}
+
+func hasPrintable(data string) bool {
+	for _, c := range data {
+		if unicode.IsPrint(c) {
+			return true
+		}
+	}
+	return false
+}
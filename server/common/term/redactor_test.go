@@ -0,0 +1,118 @@
+package term
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// redactorStep is input typed or output written to a terminal.
+type redactorStep struct {
+	input  string
+	output string
+}
+
+func TestRedactor(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []redactorStep
+		// flush ends the recording with input held back
+		flush bool
+		want  []string
+	}{
+		{
+			name:  "echoed keystrokes",
+			steps: []redactorStep{{input: "l"}, {output: "l"}, {input: "s"}, {output: "s"}, {input: "\r"}, {output: "\r\n"}},
+			want:  []string{"l", "s", "\r"},
+		},
+		{
+			name:  "echoed in one read",
+			steps: []redactorStep{{input: "l"}, {input: "s"}, {output: "ls"}},
+			want:  []string{"l", "s"},
+		},
+		{
+			name:  "echo with colours",
+			steps: []redactorStep{{input: "ls"}, {output: "\x1b[32mls\x1b[0m"}},
+			want:  []string{"ls"},
+		},
+		{
+			name:  "control characters and keys are not held back",
+			steps: []redactorStep{{input: "\x03"}, {input: "\x1b[A"}, {input: "\x1bOB"}},
+			want:  []string{"\x03", "\x1b[A", "\x1bOB"},
+		},
+		{
+			name:  "echo after a cursor key",
+			steps: []redactorStep{{input: "\x1b[D"}, {input: "x"}, {output: "x\b"}},
+			want:  []string{"\x1b[D", "x"},
+		},
+		{
+			name:  "not echoed",
+			steps: []redactorStep{{input: "hunter2"}, {input: "\r"}, {output: "\r\n"}},
+			want:  []string{"[REDACTED]"},
+		},
+		{
+			name:  "input in the middle of the output",
+			steps: []redactorStep{{input: "abc"}, {output: "xabc"}},
+			want:  []string{"[REDACTED]"},
+		},
+		{
+			name:  "first character in the output",
+			steps: []redactorStep{{input: "secret"}, {output: "Sorry, try again.\r\n"}},
+			want:  []string{"[REDACTED]"},
+		},
+		{
+			name:  "out of order",
+			steps: []redactorStep{{input: "ab"}, {output: "ba"}},
+			want:  []string{"[REDACTED]"},
+		},
+		{
+			name: "partly echoed",
+			steps: []redactorStep{
+				{input: "ab"}, {output: "a"},
+				// redacted until Enter
+				{input: "c"}, {input: "\r"}, {output: "\r\n"},
+				{input: "x"}, {output: "x"},
+			},
+			want: []string{"[REDACTED]", "x"},
+		},
+		{
+			name:  "prompt",
+			steps: []redactorStep{{output: "[sudo] password for bob: "}, {input: "hunter2"}, {input: "\r"}, {output: "\r\n"}, {input: "l"}, {output: "l"}},
+			want:  []string{"[REDACTED]", "l"},
+		},
+		{
+			name:  "held back at the end",
+			steps: []redactorStep{{input: "abc"}},
+			flush: true,
+			want:  []string{"[REDACTED]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redactor, err := NewRedactor([]string{`(?i)password[^:]*:\s*$`}, true, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			record := func(events []InputEvent) {
+				for _, event := range events {
+					got = append(got, event.Data)
+				}
+			}
+			for _, step := range tt.steps {
+				if step.input != "" {
+					record(redactor.Input(time.Now(), step.input))
+				}
+				if step.output != "" {
+					record(redactor.Output(step.output))
+				}
+			}
+			if tt.flush {
+				record(redactor.Flush())
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("recorded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package term
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Screen is a minimal VT100/xterm emulator, it keeps the text of the screen
+// and enough state to follow shells and full screen programs. Attributes
+// such as colours are dropped.
+type Screen struct {
+	Cols int
+	Rows int
+	// OnScroll receives every line that leaves the main screen, because it
+	// scrolls off or the whole screen is cleared.
+	OnScroll func(line string)
+
+	lines [][]rune
+	x, y  int
+	// top and bottom are the scrolling region, bottom is exclusive
+	top, bottom int
+	// wrap is set after a character was written to the last column
+	wrap   bool
+	alt    bool
+	main   [][]rune
+	mainX  int
+	mainY  int
+	savedX int
+	savedY int
+	// scrolled counts the lines scrolled off the main screen
+	scrolled int
+
+	state  int
+	params []byte
+}
+
+const (
+	stateGround = iota
+	stateEscape
+	stateCsi
+	stateOsc
+	stateOscEscape
+	stateCharset
+)
+
+// MaxCols and MaxRows bound the size of a Screen, whatever size a client
+// or a recording asks for.
+const (
+	MaxCols = 1000
+	MaxRows = 1000
+)
+
+func NewScreen(cols, rows int) *Screen {
+	if cols <= 0 {
+		cols = 80
+	}
+	if rows <= 0 {
+		rows = 24
+	}
+	cols, rows = clamp(cols, 1, MaxCols), clamp(rows, 1, MaxRows)
+	s := &Screen{Cols: cols, Rows: rows}
+	s.lines = newLines(cols, rows)
+	s.bottom = rows
+	return s
+}
+
+func newLines(cols, rows int) [][]rune {
+	lines := make([][]rune, rows)
+	for i := range lines {
+		lines[i] = newLine(cols)
+	}
+	return lines
+}
+
+func newLine(cols int) []rune {
+	line := make([]rune, cols)
+	for i := range line {
+		line[i] = ' '
+	}
+	return line
+}
+
+// Line returns row y without trailing blanks.
+func (s *Screen) Line(y int) string {
+	if y < 0 || y >= s.Rows {
+		return ""
+	}
+	return strings.TrimRight(string(s.lines[y]), " ")
+}
+
+// Lines returns the visible rows, trailing blank rows removed.
+func (s *Screen) Lines() []string {
+	lines := make([]string, s.Rows)
+	n := 0
+	for y := range lines {
+		lines[y] = s.Line(y)
+		if lines[y] != "" {
+			n = y + 1
+		}
+	}
+	return lines[:n]
+}
+
+func (s *Screen) Cursor() (x, y int) {
+	return s.x, s.y
+}
+
+// AltScreen reports whether a full screen program switched to the alternate screen.
+func (s *Screen) AltScreen() bool {
+	return s.alt
+}
+
+// Scrolled returns the number of lines scrolled off the main screen so far.
+func (s *Screen) Scrolled() int {
+	return s.scrolled
+}
+
+// Snapshot returns the output redrawing the screen on a blank terminal of
+// its size, the cursor is left where it is on the screen.
+func (s *Screen) Snapshot() string {
+	var sb strings.Builder
+	if s.alt {
+		sb.WriteString("\x1b[?1049h\x1b[H")
+	}
+	for y := 0; y < s.Rows; y++ {
+		if y > 0 {
+			sb.WriteString("\r\n")
+		}
+		sb.WriteString(s.Line(y))
+	}
+	sb.WriteString("\x1b[" + strconv.Itoa(s.y+1) + ";" + strconv.Itoa(s.x+1) + "H")
+	return sb.String()
+}
+
+// ParseSize parses the "COLSxROWS" size of an asciicast resize event.
+func ParseSize(size string) (cols, rows int, ok bool) {
+	c, r, ok := strings.Cut(size, "x")
+	if !ok {
+		return 0, 0, false
+	}
+	cols, err1 := strconv.Atoi(c)
+	rows, err2 := strconv.Atoi(r)
+	return cols, rows, err1 == nil && err2 == nil
+}
+
+// Resize changes the screen size. When it gets shorter, rows above the
+// cursor scroll off so the cursor stays visible.
+func (s *Screen) Resize(cols, rows int) {
+	if cols <= 0 || rows <= 0 {
+		return
+	}
+	cols, rows = clamp(cols, 1, MaxCols), clamp(rows, 1, MaxRows)
+	if s.alt {
+		s.lines, _ = s.resizeLines(s.lines, s.y, cols, rows, false)
+		s.main, s.mainY = s.resizeLines(s.main, s.mainY, cols, rows, true)
+	} else {
+		s.lines, s.y = s.resizeLines(s.lines, s.y, cols, rows, true)
+	}
+	s.Cols, s.Rows = cols, rows
+	s.top, s.bottom = 0, rows
+	s.x = clamp(s.x, 0, cols-1)
+	s.y = clamp(s.y, 0, rows-1)
+	s.mainX = clamp(s.mainX, 0, cols-1)
+	s.wrap = false
+}
+
+func (s *Screen) resizeLines(lines [][]rune, y, cols, rows int, main bool) ([][]rune, int) {
+	if drop := y - rows + 1; drop > 0 {
+		if main {
+			for _, line := range lines[:drop] {
+				if s.OnScroll != nil {
+					s.OnScroll(strings.TrimRight(string(line), " "))
+				}
+			}
+			s.scrolled += drop
+		}
+		lines = lines[drop:]
+		y -= drop
+	}
+	resized := newLines(cols, rows)
+	for i := 0; i < rows && i < len(lines); i++ {
+		copy(resized[i], lines[i])
+	}
+	return resized, clamp(y, 0, rows-1)
+}
+
+func (s *Screen) Write(data string) {
+	for _, c := range data {
+		switch s.state {
+		case stateGround:
+			s.ground(c)
+		case stateEscape:
+			s.escape(c)
+		case stateCsi:
+			if c >= 0x40 && c <= 0x7e {
+				s.csi(c)
+				s.state = stateGround
+			} else if len(s.params) < 64 {
+				s.params = append(s.params, byte(c))
+			}
+		case stateOsc:
+			if c == 0x07 {
+				s.state = stateGround
+			} else if c == 0x1b {
+				s.state = stateOscEscape
+			}
+		case stateOscEscape:
+			s.state = stateGround
+		case stateCharset:
+			s.state = stateGround
+		}
+	}
+}
+
+func (s *Screen) ground(c rune) {
+	switch c {
+	case 0x1b:
+		s.state = stateEscape
+	case '\r':
+		s.x = 0
+		s.wrap = false
+	case '\n', '\v', '\f':
+		s.lineFeed()
+	case '\b':
+		if s.x > 0 {
+			s.x--
+		}
+		s.wrap = false
+	case '\t':
+		s.x = clamp((s.x/8+1)*8, 0, s.Cols-1)
+	default:
+		if c < 0x20 || c == 0x7f {
+			return
+		}
+		if s.wrap {
+			s.x = 0
+			s.lineFeed()
+		}
+		s.lines[s.y][s.x] = c
+		if s.x == s.Cols-1 {
+			s.wrap = true
+		} else {
+			s.x++
+		}
+	}
+}
+
+func (s *Screen) escape(c rune) {
+	s.state = stateGround
+	switch c {
+	case '[':
+		s.params = s.params[:0]
+		s.state = stateCsi
+	case ']':
+		s.state = stateOsc
+	case '(', ')', '*', '+', '#':
+		s.state = stateCharset
+	case '7':
+		s.savedX, s.savedY = s.x, s.y
+	case '8':
+		s.x, s.y = s.savedX, s.savedY
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.x = 0
+		s.lineFeed()
+	case 'M':
+		s.reverseLineFeed()
+	case 'c':
+		s.flush()
+		s.lines = newLines(s.Cols, s.Rows)
+		s.x, s.y = 0, 0
+		s.top, s.bottom = 0, s.Rows
+	}
+}
+
+func (s *Screen) csi(final rune) {
+	raw := string(s.params)
+	private := strings.HasPrefix(raw, "?")
+	raw = strings.TrimLeft(raw, "?>=<")
+	var params []int
+	for _, p := range strings.Split(raw, ";") {
+		n, _ := strconv.Atoi(p)
+		params = append(params, n)
+	}
+	param := func(i, def int) int {
+		if i < len(params) && params[i] > 0 {
+			return params[i]
+		}
+		return def
+	}
+
+	s.wrap = false
+	switch final {
+	case 'A':
+		s.y = clamp(s.y-param(0, 1), 0, s.Rows-1)
+	case 'B', 'e':
+		s.y = clamp(s.y+param(0, 1), 0, s.Rows-1)
+	case 'C', 'a':
+		s.x = clamp(s.x+param(0, 1), 0, s.Cols-1)
+	case 'D':
+		s.x = clamp(s.x-param(0, 1), 0, s.Cols-1)
+	case 'E':
+		s.x = 0
+		s.y = clamp(s.y+param(0, 1), 0, s.Rows-1)
+	case 'F':
+		s.x = 0
+		s.y = clamp(s.y-param(0, 1), 0, s.Rows-1)
+	case 'G', '`':
+		s.x = clamp(param(0, 1)-1, 0, s.Cols-1)
+	case 'd':
+		s.y = clamp(param(0, 1)-1, 0, s.Rows-1)
+	case 'H', 'f':
+		s.y = clamp(param(0, 1)-1, 0, s.Rows-1)
+		s.x = clamp(param(1, 1)-1, 0, s.Cols-1)
+	case 'J':
+		switch param(0, 0) {
+		case 0:
+			if s.x == 0 && s.y == 0 {
+				s.flush()
+			}
+			s.clear(s.y, s.x, s.Cols)
+			for y := s.y + 1; y < s.Rows; y++ {
+				s.clear(y, 0, s.Cols)
+			}
+		case 1:
+			for y := 0; y < s.y; y++ {
+				s.clear(y, 0, s.Cols)
+			}
+			s.clear(s.y, 0, s.x+1)
+		case 2, 3:
+			s.flush()
+			for y := 0; y < s.Rows; y++ {
+				s.clear(y, 0, s.Cols)
+			}
+		}
+	case 'K':
+		switch param(0, 0) {
+		case 0:
+			s.clear(s.y, s.x, s.Cols)
+		case 1:
+			s.clear(s.y, 0, s.x+1)
+		case 2:
+			s.clear(s.y, 0, s.Cols)
+		}
+	case 'X':
+		s.clear(s.y, s.x, s.x+param(0, 1))
+	case 'P':
+		line := s.lines[s.y]
+		n := clamp(param(0, 1), 0, s.Cols-s.x)
+		copy(line[s.x:], line[s.x+n:])
+		s.clear(s.y, s.Cols-n, s.Cols)
+	case '@':
+		line := s.lines[s.y]
+		n := clamp(param(0, 1), 0, s.Cols-s.x)
+		copy(line[s.x+n:], line[s.x:])
+		s.clear(s.y, s.x, s.x+n)
+	case 'L':
+		if s.y >= s.top && s.y < s.bottom {
+			for i := clamp(param(0, 1), 0, s.Rows); i > 0; i-- {
+				s.scrollDown(s.y, s.bottom)
+			}
+		}
+	case 'M':
+		if s.y >= s.top && s.y < s.bottom {
+			for i := clamp(param(0, 1), 0, s.Rows); i > 0; i-- {
+				s.scrollUp(s.y, s.bottom)
+			}
+		}
+	case 'S':
+		for i := clamp(param(0, 1), 0, s.Rows); i > 0; i-- {
+			s.scroll()
+		}
+	case 'T':
+		for i := clamp(param(0, 1), 0, s.Rows); i > 0; i-- {
+			s.scrollDown(s.top, s.bottom)
+		}
+	case 'r':
+		if private {
+			return
+		}
+		top := clamp(param(0, 1)-1, 0, s.Rows-1)
+		bottom := clamp(param(1, s.Rows), top+1, s.Rows)
+		s.top, s.bottom = top, bottom
+		s.x, s.y = 0, 0
+	case 's':
+		s.savedX, s.savedY = s.x, s.y
+	case 'u':
+		s.x, s.y = s.savedX, s.savedY
+	case 'h', 'l':
+		if !private {
+			return
+		}
+		for _, p := range params {
+			switch p {
+			case 47, 1047, 1049:
+				s.setAlt(final == 'h')
+			}
+		}
+	}
+}
+
+func (s *Screen) setAlt(alt bool) {
+	if alt == s.alt {
+		return
+	}
+	s.alt = alt
+	if alt {
+		s.main, s.mainX, s.mainY = s.lines, s.x, s.y
+		s.lines = newLines(s.Cols, s.Rows)
+		return
+	}
+	s.lines, s.x, s.y = s.main, s.mainX, s.mainY
+	s.main = nil
+}
+
+func (s *Screen) clear(y, from, to int) {
+	line := s.lines[y]
+	for x := clamp(from, 0, s.Cols); x < clamp(to, 0, s.Cols); x++ {
+		line[x] = ' '
+	}
+}
+
+func (s *Screen) lineFeed() {
+	s.wrap = false
+	if s.y == s.bottom-1 {
+		s.scroll()
+		return
+	}
+	if s.y < s.Rows-1 {
+		s.y++
+	}
+}
+
+func (s *Screen) reverseLineFeed() {
+	if s.y == s.top {
+		s.scrollDown(s.top, s.bottom)
+		return
+	}
+	if s.y > 0 {
+		s.y--
+	}
+}
+
+// scroll moves the scrolling region up by one line, the top line leaves the
+// screen when the region starts at the top.
+func (s *Screen) scroll() {
+	if s.top == 0 && !s.alt {
+		if s.OnScroll != nil {
+			s.OnScroll(strings.TrimRight(string(s.lines[0]), " "))
+		}
+		s.scrolled++
+	}
+	s.scrollUp(s.top, s.bottom)
+}
+
+// flush passes the rows of the main screen to OnScroll before it is cleared.
+func (s *Screen) flush() {
+	if s.alt || s.OnScroll == nil {
+		return
+	}
+	for _, line := range s.Lines() {
+		s.OnScroll(line)
+	}
+}
+
+func (s *Screen) scrollUp(top, bottom int) {
+	first := s.lines[top]
+	copy(s.lines[top:bottom-1], s.lines[top+1:bottom])
+	s.lines[bottom-1] = first
+	s.clear(bottom-1, 0, s.Cols)
+}
+
+func (s *Screen) scrollDown(top, bottom int) {
+	last := s.lines[bottom-1]
+	copy(s.lines[top+1:bottom], s.lines[top:bottom-1])
+	s.lines[top] = last
+	s.clear(top, 0, s.Cols)
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,94 @@
+package term
+
+import (
+	"strings"
+	"sync"
+)
+
+// DefaultShadowScrollback is the number of lines a Shadow keeps after they
+// scroll off the screen.
+const DefaultShadowScrollback = 1000
+
+// Shadow follows the output of a live terminal, so that observers joining
+// late are shown the screen and the last lines that scrolled off it. Until
+// the first observer joins it only keeps the size of the terminal, so
+// sessions nobody watches do not emulate their output.
+type Shadow struct {
+	mutex      sync.Mutex
+	cols, rows int
+	screen     *Screen
+	scrollback []string
+	max        int
+}
+
+func NewShadow(cols, rows, scrollback int) *Shadow {
+	return &Shadow{cols: cols, rows: rows, max: scrollback}
+}
+
+// follow starts following the output on a blank screen.
+func (s *Shadow) follow() {
+	s.screen = NewScreen(s.cols, s.rows)
+	s.screen.OnScroll = func(line string) {
+		if s.max <= 0 {
+			return
+		}
+		// Trimmed in batches, so lines are not moved on every scroll
+		if len(s.scrollback) >= 2*s.max {
+			s.scrollback = append(s.scrollback[:0], s.scrollback[len(s.scrollback)-s.max:]...)
+		}
+		s.scrollback = append(s.scrollback, line)
+	}
+}
+
+// Write follows output of the terminal, send is called before the shadow
+// is unlocked so that output reaches observers in order with Join.
+func (s *Shadow) Write(data string, send func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.screen != nil {
+		s.screen.Write(data)
+	}
+	if send != nil {
+		send()
+	}
+}
+
+// Resize follows a window change of the terminal, send is called as in Write.
+func (s *Shadow) Resize(cols, rows int, send func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.screen != nil {
+		s.screen.Resize(cols, rows)
+	} else if cols > 0 && rows > 0 {
+		s.cols, s.rows = cols, rows
+	}
+	if send != nil {
+		send()
+	}
+}
+
+// Join calls join with the size of the terminal and the output redrawing
+// it on a blank terminal of that size. No output is written until join
+// returns, so an observer added by join misses nothing. The first observer
+// is shown a blank screen, output before it joined was not followed.
+func (s *Shadow) Join(join func(cols, rows int, snapshot string)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.screen == nil {
+		s.follow()
+	}
+
+	var sb strings.Builder
+	if !s.screen.AltScreen() {
+		scrollback := s.scrollback
+		if len(scrollback) > s.max {
+			scrollback = scrollback[len(scrollback)-s.max:]
+		}
+		for _, line := range scrollback {
+			sb.WriteString(line)
+			sb.WriteString("\r\n")
+		}
+	}
+	sb.WriteString(s.screen.Snapshot())
+	join(s.screen.Cols, s.screen.Rows, sb.String())
+}
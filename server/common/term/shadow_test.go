@@ -0,0 +1,32 @@
+package term
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShadow(t *testing.T) {
+	shadow := NewShadow(80, 24, DefaultShadowScrollback)
+	// Output before the first observer joined is not followed
+	shadow.Write("before\r\n", nil)
+	shadow.Resize(100000, 100000, nil)
+
+	var cols, rows int
+	var snapshot string
+	join := func(c, r int, s string) {
+		cols, rows, snapshot = c, r, s
+	}
+	shadow.Join(join)
+	if cols != MaxCols || rows != MaxRows {
+		t.Errorf("size %dx%d, want %dx%d", cols, rows, MaxCols, MaxRows)
+	}
+	if strings.Contains(snapshot, "before") {
+		t.Errorf("snapshot %q shows output before the first join", snapshot)
+	}
+
+	shadow.Write("after\r\n", nil)
+	shadow.Join(join)
+	if !strings.HasPrefix(snapshot, "after\r\n") {
+		t.Errorf("snapshot %q, want the output after the first join", snapshot)
+	}
+}
@@ -0,0 +1,194 @@
+package term
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+)
+
+const (
+	ZmodemUpload   = "upload"   // remote runs rz, the browser sends files
+	ZmodemDownload = "download" // remote runs sz, the browser receives files
+)
+
+const (
+	zPad  = '*'
+	zDle  = 0x18
+	zFile = 0x04
+)
+
+var (
+	// ZRQINIT and ZRINIT hex headers, sent by sz and rz when they start
+	zmodemSendInit    = []byte{zPad, zPad, zDle, 'B', '0', '0'}
+	zmodemReceiveInit = []byte{zPad, zPad, zDle, 'B', '0', '1'}
+	zmodemFin         = []byte{zPad, zPad, zDle, 'B', '0', '8'}
+	zmodemOver        = []byte("OO")
+	zmodemCancel      = []byte{zDle, zDle, zDle, zDle, zDle}
+	// ZmodemAbort is written to the remote to cancel a running transfer
+	ZmodemAbort = []byte{zDle, zDle, zDle, zDle, zDle, zDle, zDle, zDle, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08}
+)
+
+type ZmodemFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Zmodem tracks a single rz/sz transfer relayed through a terminal. Output
+// and Input are fed from different goroutines, the state of the transfer is
+// read with Transfer.
+type Zmodem struct {
+	Direction string
+
+	mutex     sync.Mutex
+	files     []ZmodemFile
+	bytes     int64
+	canceled  bool
+	finOutput bool
+	finInput  bool
+}
+
+// DetectZmodem looks for the start of a ZMODEM transfer in p and returns the
+// transfer direction and the offset where the binary frames begin.
+func DetectZmodem(p []byte) (direction string, index int) {
+	if i := bytes.Index(p, zmodemSendInit); i >= 0 {
+		return ZmodemDownload, i
+	}
+	if i := bytes.Index(p, zmodemReceiveInit); i >= 0 {
+		return ZmodemUpload, i
+	}
+	return "", -1
+}
+
+// DetectZmodemInput is DetectZmodem for frames written by the browser, which
+// starts a download with ZRINIT and an upload with ZRQINIT.
+func DetectZmodemInput(p []byte) (direction string, index int) {
+	direction, index = DetectZmodem(p)
+	switch direction {
+	case ZmodemDownload:
+		direction = ZmodemUpload
+	case ZmodemUpload:
+		direction = ZmodemDownload
+	}
+	return direction, index
+}
+
+func NewZmodem(direction string) *Zmodem {
+	return &Zmodem{
+		Direction: direction,
+		files:     make([]ZmodemFile, 0),
+	}
+}
+
+// Transfer returns the files sent, the bytes relayed and whether the
+// transfer was canceled so far.
+func (z *Zmodem) Transfer() (files []ZmodemFile, n int64, canceled bool) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return append([]ZmodemFile(nil), z.files...), z.bytes, z.canceled
+}
+
+// Cancel marks the transfer as canceled.
+func (z *Zmodem) Cancel() {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.canceled = true
+}
+
+// Output feeds frames read from the remote and returns the offset where the
+// transfer ended, or -1 while it is still running.
+func (z *Zmodem) Output(p []byte) int {
+	return z.feed(p, z.Direction == ZmodemDownload, &z.finOutput)
+}
+
+// Input feeds frames written by the browser, see Output.
+func (z *Zmodem) Input(p []byte) int {
+	return z.feed(p, z.Direction == ZmodemUpload, &z.finInput)
+}
+
+func (z *Zmodem) feed(p []byte, sender bool, fin *bool) int {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.bytes += int64(len(p))
+	if sender {
+		z.parseFile(p)
+	}
+	if i := bytes.Index(p, zmodemCancel); i >= 0 {
+		z.canceled = true
+		return i + len(zmodemCancel)
+	}
+	if i := bytes.Index(p, zmodemFin); i >= 0 {
+		*fin = true
+		p = p[i:]
+		if z.finOutput && z.finInput {
+			if j := bytes.Index(p, zmodemOver); j >= 0 {
+				return i + j + len(zmodemOver)
+			}
+		}
+		return -1
+	}
+	if z.finOutput && z.finInput {
+		if i := bytes.Index(p, zmodemOver); i >= 0 {
+			return i + len(zmodemOver)
+		}
+	}
+	return -1
+}
+
+// parseFile picks the file name and size out of ZFILE headers on a best
+// effort basis, headers split across reads are skipped.
+func (z *Zmodem) parseFile(p []byte) {
+	for {
+		i := bytes.Index(p, []byte{zPad, zDle})
+		if i < 0 || i+3 >= len(p) {
+			return
+		}
+		p = p[i+2:]
+		var crcLen int
+		switch p[0] {
+		case 'A':
+			crcLen = 2
+		case 'C':
+			crcLen = 4
+		default:
+			continue
+		}
+		data := unescapeZdle(p[1:])
+		if len(data) < 1+4+crcLen || data[0] != zFile {
+			continue
+		}
+		data = data[1+4+crcLen:]
+		end := bytes.IndexByte(data, 0)
+		if end <= 0 {
+			continue
+		}
+		file := ZmodemFile{Name: string(data[:end])}
+		fields := bytes.Fields(bytes.SplitN(data[end+1:], []byte{0}, 2)[0])
+		if len(fields) > 0 {
+			file.Size, _ = strconv.ParseInt(string(fields[0]), 10, 64)
+		}
+		z.files = append(z.files, file)
+	}
+}
+
+func unescapeZdle(p []byte) []byte {
+	out := make([]byte, 0, len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == zDle && i+1 < len(p) {
+			i++
+			// ZCRCE, ZCRCG, ZCRCQ and ZCRCW end a data subpacket
+			switch {
+			case p[i] >= 'h' && p[i] <= 'k':
+				return out
+			case p[i] == 'l':
+				out = append(out, 0x7f)
+			case p[i] == 'm':
+				out = append(out, 0xff)
+			default:
+				out = append(out, p[i]^0x40)
+			}
+			continue
+		}
+		out = append(out, p[i])
+	}
+	return out
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"quick-terminal/server/utils"
 
@@ -14,16 +17,47 @@ import (
 var GlobalCfg *Config
 
 type Config struct {
-	Debug  bool
-	Demo   bool
-	Server *Server
-	Guacd  *Guacd
+	Debug     bool
+	Demo      bool
+	Server    *Server
+	Guacd     *Guacd
+	Session   *Session
+	Recording *Recording
+	Auth      *Auth
+	Database  *Database
+	Events    *Events
 }
 
+// Server is the listener, DrainTimeout is how long sessions may go on after
+// a shutdown was signalled before they are closed. Client IPs are taken from
+// X-Forwarded-For only behind one of TrustedProxies, IPs or CIDR ranges.
 type Server struct {
-	Addr string
-	Cert string
-	Key  string
+	Addr           string
+	Cert           string
+	Key            string
+	DrainTimeout   time.Duration
+	TrustedProxies []string
+}
+
+// TrustedProxyNets parses TrustedProxies.
+func (s Server) TrustedProxyNets() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(s.TrustedProxies))
+	for _, proxy := range s.TrustedProxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
 }
 
 type Guacd struct {
@@ -33,6 +67,116 @@ type Guacd struct {
 	Drive     string
 }
 
+// Database stores the session history in SQLite, an empty Path disables it.
+type Database struct {
+	Path string
+}
+
+// Events posts session lifecycle events to Webhooks. A delivery is retried
+// Retries times, then appended to the DeadLetter file.
+type Events struct {
+	Webhooks   []Webhook
+	Retries    int
+	Timeout    time.Duration
+	DeadLetter string
+}
+
+// Webhook receives the events of Types, all when empty. Bodies are signed
+// with Secret when it is set.
+type Webhook struct {
+	URL    string   `mapstructure:"url"`
+	Secret string   `mapstructure:"secret" json:"-"`
+	Types  []string `mapstructure:"types"`
+}
+
+// Session limits apply to terminal and guacd sessions alike, zero disables a limit.
+type Session struct {
+	IdleInputTimeout  time.Duration
+	IdleOutputTimeout time.Duration
+	MaxDuration       time.Duration
+	TimeoutWarning    time.Duration
+}
+
+// DefaultCommandPrompt matches common shell prompts such as "user@host:~$ ",
+// "[user@host ~]# " or "host% ".
+const DefaultCommandPrompt = `^(\[[^\]]*\]|[^\s$#%>]*)[$#%>] `
+
+// Recording controls recording of native SSH sessions in asciicast format
+// and of guacd sessions in guacd's format, files are written under
+// Guacd.Recording. Guacd selects who records guacd sessions, "gateway"
+// records the relayed instructions, "guacd" lets guacd write the recording,
+// which requires guacd to share the recording directory.
+type Recording struct {
+	Enabled   bool
+	Required  bool
+	Rules     []RecordingRule
+	Input     bool
+	Redaction *RecordingRedaction
+	// Retention, zero disables the limit
+	MaxAge          time.Duration
+	MaxSize         int64 // MB
+	CleanupInterval time.Duration
+	// Segments are rotated by size or age and optionally gzipped when closed
+	SegmentSize     int64 // MB
+	SegmentDuration time.Duration
+	Compress        bool
+	// Ed25519 keys in PEM files, VerifyKey defaults to the public part of SigningKey
+	SigningKey string
+	VerifyKey  string
+	// Finished recordings are indexed for commands matching CommandPrompt
+	IndexInterval time.Duration
+	CommandPrompt string
+	Guacd         string
+	// Keystrokes logs the keys and clipboard content sent to guacd sessions
+	Keystrokes bool
+}
+
+// RecordingRule enables recording for matching targets, Host is a path.Match
+// pattern and empty fields match anything.
+type RecordingRule struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Required bool   `mapstructure:"required"`
+}
+
+// RecordingRedaction replaces recorded input typed at a prompt matching one
+// of Prompts, or not echoed by the terminal when NoEcho is set. Clipboard
+// content in keystroke logs is replaced when Clipboard is set, typed
+// characters when Keystrokes is set or within KeystrokeWindow of the start
+// of the session, where login screens are typed into.
+type RecordingRedaction struct {
+	Prompts         []string
+	NoEcho          bool
+	Clipboard       bool
+	Keystrokes      bool
+	KeystrokeWindow time.Duration
+	Marker          string
+}
+
+// Auth lists the API tokens accepted by the management endpoints.
+type Auth struct {
+	Tokens []AuthToken
+}
+
+// AuthToken is a principal of the management API. Targets restricts the
+// recordings an auditor may view by host pattern, empty allows all.
+type AuthToken struct {
+	Name    string   `mapstructure:"name"`
+	Token   string   `mapstructure:"token" json:"-"`
+	Roles   []string `mapstructure:"roles"`
+	Targets []string `mapstructure:"targets"`
+}
+
+func (t AuthToken) HasRole(role string) bool {
+	for _, r := range t.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 func SetupConfig() (*Config, error) {
 
 	viper.SetConfigName("config")
@@ -46,12 +190,50 @@ func SetupConfig() (*Config, error) {
 	pflag.String("server.addr", "", "server listen addr")
 	pflag.String("server.cert", "", "tls cert file")
 	pflag.String("server.key", "", "tls key file")
+	pflag.Duration("server.drain-timeout", 30*time.Second, "how long sessions may go on after SIGTERM before they are closed")
+	pflag.StringSlice("server.trusted-proxies", nil, "proxies whose X-Forwarded-For header is trusted for client IPs")
 
 	pflag.String("guacd.hostname", "127.0.0.1", "")
 	pflag.Int("guacd.port", 4822, "")
 	pflag.String("guacd.recording", "/usr/local/quick-terminal/data/recording", "")
 	pflag.String("guacd.drive", "/usr/local/quick-terminal/data/drive", "")
 
+	pflag.String("database.path", "/usr/local/quick-terminal/data/quick-terminal.db", "sqlite database of the session history, empty disables it")
+
+	pflag.Int("events.retries", 3, "retries of failed webhook deliveries")
+	pflag.Duration("events.timeout", 10*time.Second, "timeout of a webhook delivery")
+	pflag.String("events.dead-letter", "/usr/local/quick-terminal/data/events-dead-letter.jsonl", "file undeliverable and dropped events are appended to")
+
+	pflag.Duration("session.idle-input-timeout", 0, "disconnect sessions without user input for this long")
+	pflag.Duration("session.idle-output-timeout", 0, "disconnect sessions without remote output for this long")
+	pflag.Duration("session.max-duration", 0, "maximum session duration")
+	pflag.Duration("session.timeout-warning", time.Minute, "warn users this long before a session is disconnected")
+
+	pflag.Bool("recording.enabled", false, "record all native ssh sessions")
+	pflag.Bool("recording.required", false, "refuse sessions whose recording cannot be created")
+	pflag.Duration("recording.max-age", 0, "delete recordings older than this")
+	pflag.Int64("recording.max-size", 0, "maximum total size of recordings in MB")
+	pflag.Duration("recording.cleanup-interval", time.Hour, "")
+	pflag.Int64("recording.segment-size", 64, "rotate recording segments at this size in MB")
+	pflag.Duration("recording.segment-duration", time.Hour, "rotate recording segments after this long")
+	pflag.Bool("recording.compress", false, "gzip recording segments when they are closed")
+	pflag.String("recording.signing-key", "", "Ed25519 private key signing recording manifests")
+	pflag.String("recording.verify-key", "", "Ed25519 public key recordings are verified with")
+	pflag.Duration("recording.index-interval", time.Minute, "how often finished recordings are indexed for commands, 0 disables indexing")
+	pflag.String("recording.command-prompt", DefaultCommandPrompt, "regular expression matching shell prompts, used when input is not recorded")
+	pflag.String("recording.guacd", "gateway", "who records guacd sessions, gateway or guacd")
+	pflag.Bool("recording.keystrokes", false, "log keys and clipboard content sent to guacd sessions")
+	pflag.Bool("recording.input", false, "record user input events")
+	pflag.StringSlice("recording.redaction.prompts", []string{
+		`(?i)\b(password|passphrase|passcode|pin|otp|token|verification code)[^:\n]*:\s*$`,
+		`(?i)\[sudo\] password for [^:]*:\s*$`,
+	}, "redact input typed at prompts matching these regular expressions")
+	pflag.Bool("recording.redaction.no-echo", true, "redact input the terminal does not echo")
+	pflag.Bool("recording.redaction.clipboard", true, "redact clipboard content in keystroke logs")
+	pflag.Bool("recording.redaction.keystrokes", false, "redact typed characters in keystroke logs")
+	pflag.Duration("recording.redaction.keystroke-window", time.Minute, "redact typed characters in keystroke logs for this long after a session starts")
+	pflag.String("recording.redaction.marker", "[REDACTED]", "")
+
 	pflag.Parse()
 	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
 		return nil, err
@@ -68,11 +250,47 @@ func SetupConfig() (*Config, error) {
 		return nil, err
 	}
 
+	databasePath, err := homedir.Expand(viper.GetString("database.path"))
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey, err := homedir.Expand(viper.GetString("recording.signing-key"))
+	if err != nil {
+		return nil, err
+	}
+
+	verifyKey, err := homedir.Expand(viper.GetString("recording.verify-key"))
+	if err != nil {
+		return nil, err
+	}
+
+	var recordingRules []RecordingRule
+	if err := viper.UnmarshalKey("recording.rules", &recordingRules); err != nil {
+		return nil, err
+	}
+
+	var webhooks []Webhook
+	if err := viper.UnmarshalKey("events.webhooks", &webhooks); err != nil {
+		return nil, err
+	}
+	deadLetter, err := homedir.Expand(viper.GetString("events.dead-letter"))
+	if err != nil {
+		return nil, err
+	}
+
+	var authTokens []AuthToken
+	if err := viper.UnmarshalKey("auth.tokens", &authTokens); err != nil {
+		return nil, err
+	}
+
 	var config = &Config{
 		Server: &Server{
-			Addr: viper.GetString("server.addr"),
-			Cert: viper.GetString("server.cert"),
-			Key:  viper.GetString("server.key"),
+			Addr:           viper.GetString("server.addr"),
+			Cert:           viper.GetString("server.cert"),
+			Key:            viper.GetString("server.key"),
+			DrainTimeout:   viper.GetDuration("server.drain-timeout"),
+			TrustedProxies: viper.GetStringSlice("server.trusted-proxies"),
 		},
 		Debug: viper.GetBool("debug"),
 		Demo:  viper.GetBool("demo"),
@@ -82,6 +300,53 @@ func SetupConfig() (*Config, error) {
 			Recording: guacdRecording,
 			Drive:     guacdDrive,
 		},
+		Session: &Session{
+			IdleInputTimeout:  viper.GetDuration("session.idle-input-timeout"),
+			IdleOutputTimeout: viper.GetDuration("session.idle-output-timeout"),
+			MaxDuration:       viper.GetDuration("session.max-duration"),
+			TimeoutWarning:    viper.GetDuration("session.timeout-warning"),
+		},
+		Recording: &Recording{
+			Enabled:         viper.GetBool("recording.enabled"),
+			Required:        viper.GetBool("recording.required"),
+			Rules:           recordingRules,
+			MaxAge:          viper.GetDuration("recording.max-age"),
+			MaxSize:         viper.GetInt64("recording.max-size"),
+			CleanupInterval: viper.GetDuration("recording.cleanup-interval"),
+			SegmentSize:     viper.GetInt64("recording.segment-size"),
+			SegmentDuration: viper.GetDuration("recording.segment-duration"),
+			Compress:        viper.GetBool("recording.compress"),
+			SigningKey:      signingKey,
+			VerifyKey:       verifyKey,
+			IndexInterval:   viper.GetDuration("recording.index-interval"),
+			CommandPrompt:   viper.GetString("recording.command-prompt"),
+			Guacd:           viper.GetString("recording.guacd"),
+			Keystrokes:      viper.GetBool("recording.keystrokes"),
+			Input:           viper.GetBool("recording.input"),
+			Redaction: &RecordingRedaction{
+				Prompts:         viper.GetStringSlice("recording.redaction.prompts"),
+				NoEcho:          viper.GetBool("recording.redaction.no-echo"),
+				Clipboard:       viper.GetBool("recording.redaction.clipboard"),
+				Keystrokes:      viper.GetBool("recording.redaction.keystrokes"),
+				KeystrokeWindow: viper.GetDuration("recording.redaction.keystroke-window"),
+				Marker:          viper.GetString("recording.redaction.marker"),
+			},
+		},
+		Auth: &Auth{
+			Tokens: authTokens,
+		},
+		Database: &Database{
+			Path: databasePath,
+		},
+		Events: &Events{
+			Webhooks:   webhooks,
+			Retries:    viper.GetInt("events.retries"),
+			Timeout:    viper.GetDuration("events.timeout"),
+			DeadLetter: deadLetter,
+		},
+	}
+	if _, err := config.Server.TrustedProxyNets(); err != nil {
+		return nil, err
 	}
 	if err := utils.MkdirP(config.Guacd.Recording); err != nil {
 		panic(fmt.Sprintf("Create directory %v failed: %v", config.Guacd.Recording, err.Error()))
@@ -89,13 +354,18 @@ func SetupConfig() (*Config, error) {
 	if err := utils.MkdirP(config.Guacd.Drive); err != nil {
 		panic(fmt.Sprintf("Create directory %v failed: %v", config.Guacd.Drive, err.Error()))
 	}
+	if config.Database.Path != "" {
+		if err := utils.MkdirP(filepath.Dir(config.Database.Path)); err != nil {
+			panic(fmt.Sprintf("Create directory %v failed: %v", filepath.Dir(config.Database.Path), err.Error()))
+		}
+	}
 	return config, nil
 }
 
-func init() {
+// Init loads the server configuration into GlobalCfg, it is called by app.Run
+// so that client subcommands never touch the server flags and directories.
+func Init() error {
 	var err error
 	GlobalCfg, err = SetupConfig()
-	if err != nil {
-		panic(err)
-	}
+	return err
 }
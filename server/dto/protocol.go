@@ -0,0 +1,207 @@
+package dto
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// Terminal message types, v1 sends them as the first character of a frame
+const (
+	Closed      = 0
+	Connected   = 1
+	Data        = 2
+	Resize      = 3
+	Ping        = 4
+	ZmodemStart = 5
+	ZmodemEnd   = 6
+	Ack         = 7
+	AuthPrompt  = 8
+	Notice      = 9
+
+	// Types below are not representable as a single v1 character
+	Transfer     = 10 // raw file transfer frames, v1 sends them as binary frames
+	AuthResponse = 11
+	Control      = 12 // input control of shared sessions, see session.Control
+)
+
+const (
+	SubprotocolV2Json = "quick-terminal.v2.json"
+	SubprotocolV2Cbor = "quick-terminal.v2.cbor"
+)
+
+// Subprotocols lists the negotiable protocols, preferred first. Clients that
+// do not request any of them get v1.
+var Subprotocols = []string{SubprotocolV2Cbor, SubprotocolV2Json}
+
+var ErrUnsupportedMessage = errors.New("unsupported message")
+
+var typeNames = map[int]string{
+	Closed:       "closed",
+	Connected:    "connected",
+	Data:         "data",
+	Resize:       "resize",
+	Ping:         "ping",
+	ZmodemStart:  "file-transfer-start",
+	ZmodemEnd:    "file-transfer-end",
+	Ack:          "ack",
+	AuthPrompt:   "auth-prompt",
+	Notice:       "notice",
+	Transfer:     "file-transfer",
+	AuthResponse: "auth-response",
+	Control:      "control",
+}
+
+var typeValues = func() map[string]int {
+	values := make(map[string]int, len(typeNames))
+	for k, v := range typeNames {
+		values[v] = k
+	}
+	return values
+}()
+
+// Envelope is a v2 message, encoded as JSON text frames or CBOR binary frames.
+type Envelope struct {
+	Type    string `json:"type" cbor:"type"`
+	Data    string `json:"data,omitempty" cbor:"data,omitempty"`
+	Payload []byte `json:"payload,omitempty" cbor:"payload,omitempty"`
+	Cols    int    `json:"cols,omitempty" cbor:"cols,omitempty"`
+	Rows    int    `json:"rows,omitempty" cbor:"rows,omitempty"`
+	Code    int    `json:"code,omitempty" cbor:"code,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty" cbor:"bytes,omitempty"`
+	Echo    bool   `json:"echo,omitempty" cbor:"echo,omitempty"`
+	Level   string `json:"level,omitempty" cbor:"level,omitempty"`
+	// Participant of a shared session a control message is about
+	Participant string `json:"participant,omitempty" cbor:"participant,omitempty"`
+}
+
+// Codec converts messages to and from websocket frames.
+type Codec interface {
+	Subprotocol() string
+	Encode(msg Message) (messageType int, p []byte, err error)
+	Decode(messageType int, p []byte) (Message, error)
+}
+
+func NewCodec(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolV2Json:
+		return v2Codec{subprotocol: subprotocol, marshal: json.Marshal, unmarshal: json.Unmarshal}
+	case SubprotocolV2Cbor:
+		return v2Codec{subprotocol: subprotocol, marshal: cbor.Marshal, unmarshal: cbor.Unmarshal, binary: true}
+	default:
+		return V1Codec
+	}
+}
+
+var V1Codec Codec = v1Codec{}
+
+type v1Codec struct{}
+
+func (c v1Codec) Subprotocol() string {
+	return ""
+}
+
+func (c v1Codec) Encode(msg Message) (int, []byte, error) {
+	if msg.Type == Transfer {
+		return websocket.BinaryMessage, msg.Payload, nil
+	}
+	if msg.Type < 0 || msg.Type > 9 {
+		return 0, nil, ErrUnsupportedMessage
+	}
+	if msg.Type == Resize && msg.Content == "" {
+		p, err := json.Marshal(WindowSize{Cols: msg.Cols, Rows: msg.Rows})
+		if err != nil {
+			return 0, nil, err
+		}
+		msg.Content = base64.StdEncoding.EncodeToString(p)
+	}
+	return websocket.TextMessage, []byte(msg.ToString()), nil
+}
+
+func (c v1Codec) Decode(messageType int, p []byte) (Message, error) {
+	if messageType == websocket.BinaryMessage {
+		return Message{Type: Transfer, Payload: p}, nil
+	}
+	msg, err := ParseMessage(string(p))
+	if err != nil {
+		return msg, err
+	}
+	if msg.Type == Resize {
+		decodeString, err := base64.StdEncoding.DecodeString(msg.Content)
+		if err != nil {
+			return msg, err
+		}
+		var winSize WindowSize
+		if err := json.Unmarshal(decodeString, &winSize); err != nil {
+			return msg, err
+		}
+		msg.Cols, msg.Rows = ClampWindowSize(winSize.Cols, winSize.Rows)
+	}
+	return msg, nil
+}
+
+type v2Codec struct {
+	subprotocol string
+	marshal     func(v interface{}) ([]byte, error)
+	unmarshal   func(data []byte, v interface{}) error
+	binary      bool
+}
+
+func (c v2Codec) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c v2Codec) Encode(msg Message) (int, []byte, error) {
+	name, ok := typeNames[msg.Type]
+	if !ok {
+		return 0, nil, ErrUnsupportedMessage
+	}
+	p, err := c.marshal(Envelope{
+		Type:    name,
+		Data:    msg.Content,
+		Payload: msg.Payload,
+		Cols:    msg.Cols,
+		Rows:    msg.Rows,
+		Code:    msg.Code,
+		Bytes:   msg.Bytes,
+		Echo:    msg.Echo,
+		Level:   msg.Level,
+
+		Participant: msg.Participant,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if c.binary {
+		return websocket.BinaryMessage, p, nil
+	}
+	return websocket.TextMessage, p, nil
+}
+
+func (c v2Codec) Decode(messageType int, p []byte) (Message, error) {
+	var envelope Envelope
+	if err := c.unmarshal(p, &envelope); err != nil {
+		return Message{}, err
+	}
+	_type, ok := typeValues[envelope.Type]
+	if !ok {
+		return Message{}, ErrUnsupportedMessage
+	}
+	envelope.Cols, envelope.Rows = ClampWindowSize(envelope.Cols, envelope.Rows)
+	return Message{
+		Type:    _type,
+		Content: envelope.Data,
+		Payload: envelope.Payload,
+		Cols:    envelope.Cols,
+		Rows:    envelope.Rows,
+		Code:    envelope.Code,
+		Bytes:   envelope.Bytes,
+		Echo:    envelope.Echo,
+		Level:   envelope.Level,
+
+		Participant: envelope.Participant,
+	}, nil
+}
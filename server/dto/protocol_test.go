@@ -0,0 +1,172 @@
+package dto
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestV1RoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         Message
+		messageType int
+		frame       string
+		// want is the decoded message when it differs from msg
+		want *Message
+	}{
+		{
+			name:        "data",
+			msg:         NewMessage(Data, "ls -l\r"),
+			messageType: websocket.TextMessage,
+			frame:       "2ls -l\r",
+		},
+		{
+			name:        "empty content",
+			msg:         NewMessage(Ping, ""),
+			messageType: websocket.TextMessage,
+			frame:       "4",
+		},
+		{
+			name:        "closed",
+			msg:         NewMessage(Closed, "Exited"),
+			messageType: websocket.TextMessage,
+			frame:       "0Exited",
+		},
+		{
+			name:        "resize",
+			msg:         Message{Type: Resize, Cols: 80, Rows: 24},
+			messageType: websocket.TextMessage,
+			frame:       "3eyJjb2xzIjo4MCwicm93cyI6MjR9",
+			want:        &Message{Type: Resize, Content: "eyJjb2xzIjo4MCwicm93cyI6MjR9", Cols: 80, Rows: 24},
+		},
+		{
+			name:        "notice drops the level",
+			msg:         Message{Type: Notice, Content: "maintenance at 6pm", Level: "warning"},
+			messageType: websocket.TextMessage,
+			frame:       "9maintenance at 6pm",
+			want:        &Message{Type: Notice, Content: "maintenance at 6pm"},
+		},
+		{
+			name:        "transfer",
+			msg:         Message{Type: Transfer, Payload: []byte{0x2a, 0x2a, 0x18, 'B', 0x00, 0xff}},
+			messageType: websocket.BinaryMessage,
+			frame:       "**\x18B\x00\xff",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageType, p, err := V1Codec.Encode(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != tt.messageType || string(p) != tt.frame {
+				t.Fatalf("encoded %d %q, want %d %q", messageType, p, tt.messageType, tt.frame)
+			}
+			got, err := V1Codec.Decode(messageType, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.msg
+			if tt.want != nil {
+				want = *tt.want
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestV1Unsupported(t *testing.T) {
+	for _, _type := range []int{AuthResponse, Control, -1} {
+		if _, _, err := V1Codec.Encode(NewMessage(_type, "")); !errors.Is(err, ErrUnsupportedMessage) {
+			t.Errorf("type %d: got %v, want ErrUnsupportedMessage", _type, err)
+		}
+	}
+	if _, err := V1Codec.Decode(websocket.TextMessage, []byte("3not base64")); err == nil {
+		t.Error("invalid resize decoded")
+	}
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	messages := []Message{
+		NewMessage(Data, "ls -l\r"),
+		NewMessage(Ping, ""),
+		{Type: Resize, Cols: 132, Rows: 43},
+		{Type: Closed, Content: "Disconnected by an administrator", Code: 802},
+		{Type: Notice, Content: "maintenance at 6pm", Level: "warning"},
+		{Type: Transfer, Payload: []byte{0x2a, 0x2a, 0x18, 'B', 0x00, 0xff}},
+		{Type: ZmodemEnd, Bytes: 1 << 40},
+		{Type: AuthPrompt, Content: "Password: ", Echo: false},
+		{Type: AuthPrompt, Content: "Username: ", Echo: true},
+		{Type: AuthResponse, Content: "secret"},
+		{Type: Control, Content: "granted", Participant: "3f2a"},
+	}
+	for _, subprotocol := range Subprotocols {
+		codec := NewCodec(subprotocol)
+		if codec.Subprotocol() != subprotocol {
+			t.Fatalf("NewCodec(%q) negotiated %q", subprotocol, codec.Subprotocol())
+		}
+		wantType := websocket.TextMessage
+		if subprotocol == SubprotocolV2Cbor {
+			wantType = websocket.BinaryMessage
+		}
+		for _, msg := range messages {
+			t.Run(subprotocol+"/"+typeNames[msg.Type], func(t *testing.T) {
+				messageType, p, err := codec.Encode(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if messageType != wantType {
+					t.Errorf("frame type %d, want %d", messageType, wantType)
+				}
+				got, err := codec.Decode(messageType, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, msg) {
+					t.Errorf("decoded %+v, want %+v", got, msg)
+				}
+			})
+		}
+	}
+}
+
+func TestV2Unsupported(t *testing.T) {
+	codec := NewCodec(SubprotocolV2Json)
+	if _, _, err := codec.Encode(NewMessage(42, "")); !errors.Is(err, ErrUnsupportedMessage) {
+		t.Errorf("encode: got %v, want ErrUnsupportedMessage", err)
+	}
+	if _, err := codec.Decode(websocket.TextMessage, []byte(`{"type":"shutdown"}`)); !errors.Is(err, ErrUnsupportedMessage) {
+		t.Errorf("decode: got %v, want ErrUnsupportedMessage", err)
+	}
+	if _, err := codec.Decode(websocket.TextMessage, []byte(`{"type":`)); err == nil {
+		t.Error("truncated envelope decoded")
+	}
+	if NewCodec("") != V1Codec || NewCodec("quick-terminal.v3") != V1Codec {
+		t.Error("unknown subprotocols do not fall back to v1")
+	}
+}
+
+func TestDecodeClampsWindowSize(t *testing.T) {
+	frames := []struct {
+		codec Codec
+		frame string
+	}{
+		// {"cols":100000,"rows":-1}
+		{V1Codec, "3eyJjb2xzIjoxMDAwMDAsInJvd3MiOi0xfQ=="},
+		{NewCodec(SubprotocolV2Json), `{"type":"resize","cols":100000,"rows":-1}`},
+	}
+	for _, f := range frames {
+		msg, err := f.codec.Decode(websocket.TextMessage, []byte(f.frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Cols != MaxCols || msg.Rows != 0 {
+			t.Errorf("%q decoded to %dx%d, want %dx0", f.frame, msg.Cols, msg.Rows, MaxCols)
+		}
+	}
+}
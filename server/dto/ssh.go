@@ -5,6 +5,17 @@ import "strconv"
 type Message struct {
 	Type    int    `json:"type"`
 	Content string `json:"content"`
+
+	// Typed fields, v1 folds them into Content where it can
+	Payload []byte `json:"-"`
+	Cols    int    `json:"-"`
+	Rows    int    `json:"-"`
+	Code    int    `json:"-"`
+	Bytes   int64  `json:"-"`
+	Echo    bool   `json:"-"`
+	Level   string `json:"-"`
+
+	Participant string `json:"-"`
 }
 
 func (r Message) ToString() string {
@@ -37,3 +48,25 @@ type WindowSize struct {
 	Cols int `json:"cols"`
 	Rows int `json:"rows"`
 }
+
+// MaxCols and MaxRows bound the window size a client may ask for.
+const (
+	MaxCols = 1000
+	MaxRows = 1000
+)
+
+// ClampWindowSize limits a window size sent by a client to MaxCols and
+// MaxRows, negative sizes become 0.
+func ClampWindowSize(cols, rows int) (int, int) {
+	return clampSize(cols, MaxCols), clampSize(rows, MaxRows)
+}
+
+func clampSize(n, max int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
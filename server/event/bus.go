@@ -0,0 +1,93 @@
+package event
+
+import (
+	"sync"
+
+	"quick-terminal/server/log"
+)
+
+// QueueSize is the number of events a subscriber may lag behind, later
+// events are dropped for it and handed to its Drop method if it has one.
+const QueueSize = 1024
+
+// Subscriber receives the events of the bus. Each subscriber is called from
+// its own goroutine, in the order the events were published.
+type Subscriber interface {
+	Handle(e Event)
+}
+
+// Dropper is implemented by subscribers that keep the events dropped for
+// them, webhooks append them to their dead letter file.
+type Dropper interface {
+	Drop(e Event, reason string)
+}
+
+// SubscriberFunc adapts a function to a Subscriber.
+type SubscriberFunc func(e Event)
+
+func (f SubscriberFunc) Handle(e Event) {
+	f(e)
+}
+
+type subscription struct {
+	name       string
+	subscriber Subscriber
+	queue      chan Event
+	closed     chan struct{}
+}
+
+var (
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+)
+
+// Subscribe registers subscriber under name for every event published from
+// now on.
+func Subscribe(name string, subscriber Subscriber) {
+	s := &subscription{
+		name:       name,
+		subscriber: subscriber,
+		queue:      make(chan Event, QueueSize),
+		closed:     make(chan struct{}),
+	}
+	go func() {
+		defer close(s.closed)
+		for e := range s.queue {
+			subscriber.Handle(e)
+		}
+	}()
+	mutex.Lock()
+	subscriptions = append(subscriptions, s)
+	mutex.Unlock()
+}
+
+// Publish hands e to the subscribers without waiting for them.
+func Publish(e Event) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, s := range subscriptions {
+		select {
+		case s.queue <- e:
+		default:
+			log.Warn("event dropped", log.String("subscriber", s.name), log.String("type", e.Type), log.String("sessionId", e.SessionId))
+			if dropper, ok := s.subscriber.(Dropper); ok {
+				dropper.Drop(e, "subscriber queue full")
+			}
+		}
+	}
+}
+
+// Close stops the bus after the subscribers handled the events already
+// published, events published afterwards are discarded.
+func Close() {
+	mutex.Lock()
+	closing := subscriptions
+	subscriptions = nil
+	mutex.Unlock()
+	for _, s := range closing {
+		close(s.queue)
+	}
+	for _, s := range closing {
+		<-s.closed
+	}
+}
@@ -0,0 +1,87 @@
+package event
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types, Data of an event holds the payload named after its type.
+const (
+	// SessionCreated is published when a client asks for a connection, Session
+	SessionCreated = "session.created"
+	// SessionConnected is published once the target accepted it, Session
+	SessionConnected = "session.connected"
+	// SessionResized is published when the client window changes, Resized
+	SessionResized = "session.resized"
+	// FileOperation is published for every SFTP operation and every file of
+	// a ZMODEM transfer, File
+	FileOperation = "session.file"
+	// SessionDisconnected is published once per connection, Disconnected
+	SessionDisconnected = "session.disconnected"
+	// RecordingFinished is published when a recording was closed, Recording
+	RecordingFinished = "recording.finished"
+)
+
+// Types lists the event types.
+var Types = []string{SessionCreated, SessionConnected, SessionResized, FileOperation, SessionDisconnected, RecordingFinished}
+
+// Event is a session lifecycle event, SessionId is the id the client
+// connected with and Connection the id of the connection in the session
+// history, reconnects share the first but not the second.
+type Event struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Time       time.Time   `json:"time"`
+	SessionId  string      `json:"sessionId"`
+	Connection string      `json:"connection,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+type Session struct {
+	Protocol  string `json:"protocol"`
+	Mode      string `json:"mode"`
+	Target    string `json:"target"`
+	Username  string `json:"username"`
+	Principal string `json:"principal"`
+	ClientIP  string `json:"clientIp"`
+	Recording string `json:"recording,omitempty"`
+}
+
+type Resized struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+// File is an SFTP operation or a file sent by ZMODEM, NewPath is set by
+// renames and Size by ZMODEM transfers.
+type File struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	NewPath   string `json:"newPath,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type Disconnected struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type Recording struct {
+	Recording string  `json:"recording"`
+	Format    string  `json:"format"`
+	Size      int64   `json:"size"`
+	Duration  float64 `json:"duration"` // seconds
+}
+
+func New(eventType, sessionId, connection string, data interface{}) Event {
+	return Event{
+		ID:         uuid.NewString(),
+		Type:       eventType,
+		Time:       time.Now(),
+		SessionId:  sessionId,
+		Connection: connection,
+		Data:       data,
+	}
+}
@@ -0,0 +1,164 @@
+package event
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"quick-terminal/server/log"
+)
+
+// Headers of webhook requests. The signature is the hex HMAC-SHA256 of the
+// body keyed with the secret of the webhook, prefixed with "sha256=".
+const (
+	HeaderEvent     = "X-Quick-Event"
+	HeaderDelivery  = "X-Quick-Delivery"
+	HeaderSignature = "X-Quick-Signature"
+)
+
+// Webhook posts events as JSON to a URL. Failed deliveries are retried with
+// a doubling backoff and appended to the dead letter file when every
+// attempt failed, as are the events the bus dropped for the webhook.
+type Webhook struct {
+	URL        string
+	Secret     string
+	Retries    int
+	Backoff    time.Duration
+	DeadLetter string
+	// types selects the posted events, nil posts all
+	types  map[string]bool
+	client *http.Client
+}
+
+func NewWebhook(url, secret string, types []string, retries int, timeout time.Duration, deadLetter string) *Webhook {
+	w := &Webhook{
+		URL:        url,
+		Secret:     secret,
+		Retries:    retries,
+		Backoff:    time.Second,
+		DeadLetter: deadLetter,
+		client:     &http.Client{Timeout: timeout},
+	}
+	if len(types) > 0 {
+		w.types = make(map[string]bool)
+		for _, t := range types {
+			w.types[t] = true
+		}
+	}
+	return w
+}
+
+func (w *Webhook) Handle(e Event) {
+	if w.types != nil && !w.types[e.Type] {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Warn("encode event failed", log.String("type", e.Type), log.NamedError("err", err))
+		return
+	}
+	backoff := w.Backoff
+	for attempt := 0; ; attempt++ {
+		if err = w.post(e, body); err == nil {
+			return
+		}
+		if attempt >= w.Retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	log.Warn("webhook delivery failed", log.String("url", w.URL), log.String("type", e.Type), log.String("event", e.ID), log.NamedError("err", err))
+	w.deadLetter(e, body, w.Retries+1, err.Error())
+}
+
+// Drop appends an event the bus dropped before it was posted to the dead
+// letter file, with no attempts.
+func (w *Webhook) Drop(e Event, reason string) {
+	if w.types != nil && !w.types[e.Type] {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Warn("encode event failed", log.String("type", e.Type), log.NamedError("err", err))
+		return
+	}
+	w.deadLetter(e, body, 0, reason)
+}
+
+func (w *Webhook) deadLetter(e Event, body []byte, attempts int, reason string) {
+	if w.DeadLetter == "" {
+		return
+	}
+	if err := writeDeadLetter(w.DeadLetter, deadLetter{Time: time.Now(), URL: w.URL, Attempts: attempts, Error: reason, Event: body}); err != nil {
+		log.Error("write dead letter failed", log.String("file", w.DeadLetter), log.String("event", e.ID), log.NamedError("err", err))
+	}
+}
+
+func (w *Webhook) post(e Event, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderEvent, e.Type)
+	request.Header.Set(HeaderDelivery, e.ID)
+	if w.Secret != "" {
+		request.Header.Set(HeaderSignature, Sign(w.Secret, body))
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value of body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter is a line of the dead letter file, Event is the body that
+// could not be delivered.
+type deadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Event    json.RawMessage `json:"event"`
+}
+
+var deadLetterMutex sync.Mutex
+
+func writeDeadLetter(file string, letter deadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
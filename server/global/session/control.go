@@ -0,0 +1,166 @@
+package session
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Input arbitration modes of a shared terminal session.
+const (
+	// InputOwnerOnly lets only the owner type, participants watch
+	InputOwnerOnly = "owner-only"
+	// InputShared lets everyone type
+	InputShared = "shared"
+	// InputRequestControl lets one participant at a time type, control is
+	// requested from and granted by the owner
+	InputRequestControl = "request-control"
+)
+
+// Owner is the participant ID of the owner of a session.
+const Owner = "owner"
+
+var ErrInvalidInputMode = errors.New("invalid input mode")
+
+// Share is a link letting a participant join a session with write access.
+type Share struct {
+	Token       string    `json:"token"`
+	Name        string    `json:"name"`
+	CreatedTime time.Time `json:"createdTime"`
+}
+
+// Control holds the shares of a session and decides whose input reaches it.
+type Control struct {
+	mutex  sync.Mutex
+	mode   string
+	holder string
+	shares map[string]*Share
+	shared bool
+}
+
+func NewControl() *Control {
+	return &Control{
+		mode:   InputOwnerOnly,
+		holder: Owner,
+		shares: make(map[string]*Share),
+	}
+}
+
+func (c *Control) Mode() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.mode
+}
+
+// SetMode changes the arbitration mode, control returns to the owner.
+func (c *Control) SetMode(mode string) error {
+	switch mode {
+	case InputOwnerOnly, InputShared, InputRequestControl:
+	default:
+		return ErrInvalidInputMode
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.mode = mode
+	c.holder = Owner
+	return nil
+}
+
+// Holder returns the participant in control in request-control mode.
+func (c *Control) Holder() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.holder
+}
+
+// CanWrite reports whether input of participant reaches the session.
+func (c *Control) CanWrite(participant string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch c.mode {
+	case InputShared:
+		return true
+	case InputRequestControl:
+		return c.holder == participant
+	default:
+		return participant == Owner
+	}
+}
+
+// Grant passes control to participant, it reports false unless the session
+// is in request-control mode.
+func (c *Control) Grant(participant string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.mode != InputRequestControl {
+		return false
+	}
+	c.holder = participant
+	return true
+}
+
+// Release returns control to the owner if participant holds it.
+func (c *Control) Release(participant string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.holder != participant || participant == Owner {
+		return false
+	}
+	c.holder = Owner
+	return true
+}
+
+// AddShare creates a share link named name.
+func (c *Control) AddShare(name string) *Share {
+	share := &Share{
+		Token:       uuid.NewString(),
+		Name:        name,
+		CreatedTime: time.Now(),
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.shares[share.Token] = share
+	c.shared = true
+	return share
+}
+
+// Share returns the share with token, nil if there is none.
+func (c *Control) Share(token string) *Share {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.shares[token]
+}
+
+// RemoveShare revokes a share, it reports whether it existed.
+func (c *Control) RemoveShare(token string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.shares[token]
+	delete(c.shares, token)
+	return ok
+}
+
+// Shares returns the shares of the session, oldest first.
+func (c *Control) Shares() []Share {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	shares := make([]Share, 0, len(c.shares))
+	for _, share := range c.shares {
+		shares = append(shares, *share)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedTime.Before(shares[j].CreatedTime)
+	})
+	return shares
+}
+
+// Shared reports whether the session was ever shared, its input is then
+// tagged with the participant in the audit log.
+func (c *Control) Shared() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.shared
+}
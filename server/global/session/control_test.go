@@ -0,0 +1,176 @@
+package session
+
+import (
+	"errors"
+	"testing"
+)
+
+// controlStep is an action on a Control and whether it should succeed.
+type controlStep struct {
+	action      string // grant, release or mode
+	participant string
+	ok          bool
+}
+
+func TestControl(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		steps []controlStep
+		// writers may type afterwards, the other participants may not
+		writers []string
+		holder  string
+	}{
+		{
+			name:    "owner only by default",
+			writers: []string{Owner},
+			holder:  Owner,
+		},
+		{
+			name:    "owner only refuses a grant",
+			mode:    InputOwnerOnly,
+			steps:   []controlStep{{"grant", "alice", false}},
+			writers: []string{Owner},
+			holder:  Owner,
+		},
+		{
+			name:    "shared",
+			mode:    InputShared,
+			writers: []string{Owner, "alice", "bob"},
+			holder:  Owner,
+		},
+		{
+			name:    "shared refuses a grant",
+			mode:    InputShared,
+			steps:   []controlStep{{"grant", "alice", false}},
+			writers: []string{Owner, "alice", "bob"},
+			holder:  Owner,
+		},
+		{
+			name:    "request control starts with the owner",
+			mode:    InputRequestControl,
+			writers: []string{Owner},
+			holder:  Owner,
+		},
+		{
+			name:    "granted participant types alone",
+			mode:    InputRequestControl,
+			steps:   []controlStep{{"grant", "alice", true}},
+			writers: []string{"alice"},
+			holder:  "alice",
+		},
+		{
+			name:    "grant passes control on",
+			mode:    InputRequestControl,
+			steps:   []controlStep{{"grant", "alice", true}, {"grant", "bob", true}},
+			writers: []string{"bob"},
+			holder:  "bob",
+		},
+		{
+			name:    "holder releases control",
+			mode:    InputRequestControl,
+			steps:   []controlStep{{"grant", "alice", true}, {"release", "alice", true}},
+			writers: []string{Owner},
+			holder:  Owner,
+		},
+		{
+			name:    "only the holder releases control",
+			mode:    InputRequestControl,
+			steps:   []controlStep{{"grant", "alice", true}, {"release", "bob", false}, {"release", Owner, false}},
+			writers: []string{"alice"},
+			holder:  "alice",
+		},
+		{
+			name:    "owner takes control back",
+			mode:    InputRequestControl,
+			steps:   []controlStep{{"grant", "alice", true}, {"grant", Owner, true}},
+			writers: []string{Owner},
+			holder:  Owner,
+		},
+		{
+			name:    "mode change returns control to the owner",
+			mode:    InputRequestControl,
+			steps:   []controlStep{{"grant", "alice", true}, {"mode", InputRequestControl, true}},
+			writers: []string{Owner},
+			holder:  Owner,
+		},
+		{
+			name:    "invalid mode is refused",
+			mode:    InputShared,
+			steps:   []controlStep{{"mode", "anyone", false}},
+			writers: []string{Owner, "alice", "bob"},
+			holder:  Owner,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			control := NewControl()
+			if tt.mode != "" {
+				if err := control.SetMode(tt.mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, step := range tt.steps {
+				var ok bool
+				switch step.action {
+				case "grant":
+					ok = control.Grant(step.participant)
+				case "release":
+					ok = control.Release(step.participant)
+				case "mode":
+					err := control.SetMode(step.participant)
+					if err != nil && !errors.Is(err, ErrInvalidInputMode) {
+						t.Fatal(err)
+					}
+					ok = err == nil
+				}
+				if ok != step.ok {
+					t.Errorf("step %d: %s %s = %v, want %v", i+1, step.action, step.participant, ok, step.ok)
+				}
+			}
+
+			writers := make(map[string]bool)
+			for _, participant := range tt.writers {
+				writers[participant] = true
+			}
+			for _, participant := range []string{Owner, "alice", "bob"} {
+				if got := control.CanWrite(participant); got != writers[participant] {
+					t.Errorf("CanWrite(%s) = %v, want %v", participant, got, writers[participant])
+				}
+			}
+			if got := control.Holder(); got != tt.holder {
+				t.Errorf("holder %s, want %s", got, tt.holder)
+			}
+		})
+	}
+}
+
+func TestControlShares(t *testing.T) {
+	control := NewControl()
+	if control.Shared() {
+		t.Fatal("new session is shared")
+	}
+	first := control.AddShare("alice")
+	second := control.AddShare("bob")
+	if !control.Shared() || first.Token == second.Token {
+		t.Fatalf("shares %+v %+v", first, second)
+	}
+	if share := control.Share(second.Token); share == nil || share.Name != "bob" {
+		t.Errorf("Share(%s) = %+v", second.Token, share)
+	}
+	if shares := control.Shares(); len(shares) != 2 || shares[0].Name != "alice" || shares[1].Name != "bob" {
+		t.Errorf("shares %+v, want alice and bob", shares)
+	}
+
+	if !control.RemoveShare(first.Token) || control.RemoveShare(first.Token) {
+		t.Error("share removed twice")
+	}
+	if control.Share(first.Token) != nil || len(control.Shares()) != 1 {
+		t.Error("removed share still listed")
+	}
+	// A session stays shared for the audit log once a share was created
+	control.RemoveShare(second.Token)
+	if !control.Shared() {
+		t.Error("session no longer shared")
+	}
+}
@@ -1,15 +1,29 @@
 package session
 
 import (
+	"encoding/base64"
 	"quick-terminal/server/common/guacamole"
 	"quick-terminal/server/common/term"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"quick-terminal/server/dto"
+	"quick-terminal/server/metrics"
 
 	"github.com/gorilla/websocket"
 )
 
+// Observers are written to by their own goroutine, so that a slow observer
+// never blocks the session it watches. An observer more than
+// ObserverQueueSize messages behind is dropped, a write to it times out
+// after ObserverWriteTimeout.
+const (
+	ObserverQueueSize    = 256
+	ObserverWriteTimeout = 10 * time.Second
+)
+
 type Session struct {
 	ID            string
 	Protocol      string
@@ -17,34 +31,186 @@ type Session struct {
 	WebSocket     *websocket.Conn
 	GuacdTunnel   *guacamole.Tunnel
 	QuickTerminal *term.QuickTerminal
+	Codec         dto.Codec
 	Observer      *Manager
-	mutex         sync.Mutex
+	Channels      *Manager
+	// Shadow follows the terminal output for observers, nil for guacd sessions
+	Shadow *term.Shadow
+	mutex  sync.Mutex
+
+	Target    string
+	Username  string
+	Principal string
+
+	// Control arbitrates the input of participants joined through shares
+	Control *Control
+	// WriteInput relays input of a participant to the terminal
+	WriteInput func(participant string, input []byte) error
+	// Share is the token an observer joined with, it may then type
+	Share string
 
-	Uptime   int64
+	// Hostname is the target host the client asked for
 	Hostname string
+	ClientIP string
+	// History is the id of the connection in the session history and its
+	// events, empty for observers and channels
+	History string
+	// Recording is the directory the session is recorded to, kept from the
+	// retention cleanup while the session is live
+	Recording string
+	// KeyLogger logs the keystrokes of a guacd session, including those of
+	// observers joined to type, nil when they are not logged
+	KeyLogger *guacamole.KeyLogger
+
+	ConnectedTime time.Time
+	lastInput     int64
+	lastOutput    int64
+	// bytesIn is sent by the client to the target, bytesOut the other way
+	bytesIn  int64
+	bytesOut int64
+
+	// queue holds the messages of an observer until they are written
+	queue        chan dto.Message
+	done         chan struct{}
+	closeOnce    sync.Once
+	writeTimeout time.Duration
+}
+
+func (s *Session) AddBytesIn(n int) {
+	atomic.AddInt64(&s.bytesIn, int64(n))
+	metrics.BytesIn(s.Mode, n)
+}
+
+func (s *Session) AddBytesOut(n int) {
+	atomic.AddInt64(&s.bytesOut, int64(n))
+	metrics.BytesOut(s.Mode, n)
+}
+
+func (s *Session) BytesIn() int64 {
+	return atomic.LoadInt64(&s.bytesIn)
+}
+
+func (s *Session) BytesOut() int64 {
+	return atomic.LoadInt64(&s.bytesOut)
+}
+
+// TouchInput records user input, it resets the idle input timeout.
+func (s *Session) TouchInput() {
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+}
+
+// TouchOutput records remote output, it resets the idle output timeout.
+func (s *Session) TouchOutput() {
+	atomic.StoreInt64(&s.lastOutput, time.Now().UnixNano())
+}
+
+func (s *Session) LastInput() time.Time {
+	if t := atomic.LoadInt64(&s.lastInput); t > 0 {
+		return time.Unix(0, t)
+	}
+	return s.ConnectedTime
+}
+
+func (s *Session) LastOutput() time.Time {
+	if t := atomic.LoadInt64(&s.lastOutput); t > 0 {
+		return time.Unix(0, t)
+	}
+	return s.ConnectedTime
 }
 
 func (s *Session) WriteMessage(msg dto.Message) error {
 	if s.WebSocket == nil {
 		return nil
 	}
+	codec := s.Codec
+	if codec == nil {
+		codec = dto.V1Codec
+	}
+	messageType, message, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
 	defer s.mutex.Unlock()
 	s.mutex.Lock()
-	message := []byte(msg.ToString())
-	return s.WebSocket.WriteMessage(websocket.TextMessage, message)
+	return s.writeWebSocket(messageType, message)
 }
 
 func (s *Session) WriteString(str string) error {
+	return s.WriteText([]byte(str))
+}
+
+// WriteText writes a text frame, such as the instructions of guacd.
+func (s *Session) WriteText(message []byte) error {
 	if s.WebSocket == nil {
 		return nil
 	}
 	defer s.mutex.Unlock()
 	s.mutex.Lock()
-	message := []byte(str)
-	return s.WebSocket.WriteMessage(websocket.TextMessage, message)
+	return s.writeWebSocket(websocket.TextMessage, message)
+}
+
+// Disconnect sends the error and disconnect instructions of a guacd session,
+// like guacamole.Disconnect but under the lock of the session.
+func (s *Session) Disconnect(code int, reason string) {
+	// guacd cannot handle Chinese characters, so base64 encoding is performed.
+	err := guacamole.NewInstruction("error", base64.StdEncoding.EncodeToString([]byte(reason)), strconv.Itoa(code))
+	_ = s.WriteString(err.String())
+	disconnect := guacamole.NewInstruction("disconnect")
+	_ = s.WriteString(disconnect.String())
+}
+
+func (s *Session) writeWebSocket(messageType int, message []byte) error {
+	if s.writeTimeout > 0 {
+		_ = s.WebSocket.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	err := s.WebSocket.WriteMessage(messageType, message)
+	if err != nil {
+		metrics.WebsocketWriteError(s.Mode)
+	}
+	return err
+}
+
+// Observe starts writing the messages queued by Send to the websocket of an
+// observer. It is stopped by Close, or by a failed write.
+func (s *Session) Observe() {
+	s.queue = make(chan dto.Message, ObserverQueueSize)
+	s.done = make(chan struct{})
+	s.writeTimeout = ObserverWriteTimeout
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case msg := <-s.queue:
+				if err := s.WriteMessage(msg); err != nil {
+					s.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Send queues msg for an observer without blocking, it reports false when
+// the queue is full. Sessions not observing are written to directly.
+func (s *Session) Send(msg dto.Message) bool {
+	if s.queue == nil {
+		return s.WriteMessage(msg) == nil
+	}
+	select {
+	case s.queue <- msg:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *Session) Close() {
+	if s.done != nil {
+		s.closeOnce.Do(func() {
+			close(s.done)
+		})
+	}
 	if s.GuacdTunnel != nil {
 		_ = s.GuacdTunnel.Close()
 	}
@@ -71,6 +237,12 @@ func NewObserver(id string) *Manager {
 	}
 }
 
+func NewChannels(id string) *Manager {
+	return &Manager{
+		id: id,
+	}
+}
+
 func (m *Manager) GetById(id string) *Session {
 	value, ok := m.sessions.Load(id)
 	if ok {
@@ -90,6 +262,9 @@ func (m *Manager) Del(id string) {
 		if session.Observer != nil {
 			session.Observer.Clear()
 		}
+		if session.Channels != nil {
+			session.Channels.Clear()
+		}
 	}
 	m.sessions.Delete(id)
 }
@@ -104,6 +279,16 @@ func (m *Manager) Clear() {
 	})
 }
 
+// Len returns the number of sessions.
+func (m *Manager) Len() int {
+	n := 0
+	m.sessions.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
 func (m *Manager) Range(f func(key string, value *Session)) {
 	m.sessions.Range(func(key, value interface{}) bool {
 		if session, ok := value.(*Session); ok {
@@ -0,0 +1,129 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"quick-terminal/server/common/guacamole"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWebSocket returns the server side of a websocket and the client
+// connected to it.
+func newTestWebSocket(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return server, client
+}
+
+func instructionString(opcode string, args ...string) string {
+	i := guacamole.NewInstruction(opcode, args...)
+	return i.String()
+}
+
+// TestSessionConcurrentWrites streams the output of a guacd session to its
+// owner while an observer types into it and notices are sent, as the
+// handlers, an observer joined to type and the admin endpoints do.
+func TestSessionConcurrentWrites(t *testing.T) {
+	const instructions = 200
+
+	ws, client := newTestWebSocket(t)
+	keyLogger, err := guacamole.NewKeyLogger(t.TempDir(), guacamole.KeyLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyLogger.Close()
+	owner := &Session{ID: "owner", Mode: "guacd", WebSocket: ws, KeyLogger: keyLogger}
+	observer := &Session{ID: "observer", Mode: "guacd", Principal: "alice"}
+
+	received := make(chan int)
+	go func() {
+		var n int
+		for {
+			_, p, err := client.ReadMessage()
+			if err != nil {
+				received <- n
+				return
+			}
+			n += strings.Count(string(p), ";")
+		}
+	}()
+
+	// String caches the encoded instruction, encode them before sharing
+	output := instructionString("sync", "1000")
+	key := instructionString("key", "97", "1")
+	notice := instructionString("notice", "info", "bWFpbnRlbmFuY2U=")
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < instructions; i++ {
+			owner.AddBytesOut(len(output))
+			owner.TouchOutput()
+			if err := owner.WriteText([]byte(output)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < instructions; i++ {
+			owner.AddBytesIn(len(key))
+			owner.TouchInput()
+			_ = owner.KeyLogger.Write([]byte(key))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < instructions; i++ {
+			owner.AddBytesIn(len(key))
+			owner.TouchInput()
+			_ = owner.KeyLogger.WriteAs(observer.Principal, []byte(key))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < instructions; i++ {
+			if err := owner.WriteString(notice); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	owner.Disconnect(0, "Exited")
+	_ = ws.Close()
+
+	// Both streams, the error and the disconnect instruction
+	if n := <-received; n != 2*instructions+2 {
+		t.Errorf("received %d instructions, want %d", n, 2*instructions+2)
+	}
+	if n, want := owner.BytesIn(), int64(2*instructions*len(key)); n != want {
+		t.Errorf("%d bytes in, want %d", n, want)
+	}
+}
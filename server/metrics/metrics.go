@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Label values are normalized to fixed sets, so clients can not grow the
+// number of series.
+var (
+	protocols = map[string]bool{"ssh": true, "rdp": true, "vnc": true, "telnet": true, "kubernetes": true}
+	modes     = map[string]bool{"native": true, "terminal": true, "guacd": true}
+)
+
+func protocolLabel(protocol string) string {
+	if protocols[protocol] {
+		return protocol
+	}
+	return "other"
+}
+
+func modeLabel(mode string) string {
+	if modes[mode] {
+		return mode
+	}
+	return "other"
+}
+
+var registry = prometheus.NewRegistry()
+
+var (
+	connectionAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "quick_connection_attempts_total",
+		Help: "Session connection attempts.",
+	}, []string{"protocol", "mode"})
+	connectionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "quick_connection_failures_total",
+		Help: "Session connections that failed to establish, by close code.",
+	}, []string{"protocol", "mode", "code"})
+	sessionCloses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "quick_session_closes_total",
+		Help: "Established sessions closed, by close code.",
+	}, []string{"code"})
+	sshHandshake = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "quick_ssh_handshake_seconds",
+		Help:    "Time to connect and authenticate to SSH targets.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	guacdHandshake = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "quick_guacd_handshake_seconds",
+		Help:    "Time of the guacd handshake, from connecting to guacd to ready.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	bytesRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "quick_relayed_bytes_total",
+		Help: "Bytes relayed, in from clients to targets and out from targets to clients.",
+	}, []string{"direction", "mode"})
+	websocketWriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "quick_websocket_write_errors_total",
+		Help: "Failed writes to client websockets.",
+	}, []string{"mode"})
+	sftpOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "quick_sftp_operations_total",
+		Help: "SFTP operations, by result.",
+	}, []string{"operation", "result"})
+	sftpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "quick_sftp_operation_seconds",
+		Help:    "Duration of SFTP operations.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 9),
+	}, []string{"operation"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		connectionAttempts,
+		connectionFailures,
+		sessionCloses,
+		sshHandshake,
+		guacdHandshake,
+		bytesRelayed,
+		websocketWriteErrors,
+		sftpOperations,
+		sftpDuration,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RegisterActiveSessions reports the live sessions by protocol and mode,
+// counted by sessions when scraped.
+func RegisterActiveSessions(sessions func(observe func(protocol, mode string))) {
+	registry.MustRegister(&activeSessions{
+		desc:     prometheus.NewDesc("quick_active_sessions", "Live sessions.", []string{"protocol", "mode"}, nil),
+		sessions: sessions,
+	})
+}
+
+type activeSessions struct {
+	desc     *prometheus.Desc
+	sessions func(observe func(protocol, mode string))
+}
+
+func (a *activeSessions) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.desc
+}
+
+func (a *activeSessions) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[[2]string]int)
+	a.sessions(func(protocol, mode string) {
+		counts[[2]string{protocolLabel(protocol), modeLabel(mode)}]++
+	})
+	for labels, n := range counts {
+		ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, float64(n), labels[0], labels[1])
+	}
+}
+
+func ConnectionAttempt(protocol, mode string) {
+	connectionAttempts.WithLabelValues(protocolLabel(protocol), modeLabel(mode)).Inc()
+}
+
+func ConnectionFailure(protocol, mode string, code int) {
+	connectionFailures.WithLabelValues(protocolLabel(protocol), modeLabel(mode), strconv.Itoa(code)).Inc()
+}
+
+func SessionClosed(code int) {
+	sessionCloses.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func SshHandshake(start time.Time) {
+	sshHandshake.Observe(time.Since(start).Seconds())
+}
+
+func GuacdHandshake(start time.Time) {
+	guacdHandshake.Observe(time.Since(start).Seconds())
+}
+
+func BytesIn(mode string, n int) {
+	bytesRelayed.WithLabelValues("in", modeLabel(mode)).Add(float64(n))
+}
+
+func BytesOut(mode string, n int) {
+	bytesRelayed.WithLabelValues("out", modeLabel(mode)).Add(float64(n))
+}
+
+func WebsocketWriteError(mode string) {
+	websocketWriteErrors.WithLabelValues(modeLabel(mode)).Inc()
+}
+
+// SftpOperation records an SFTP operation started at start, operation
+// must be one of a fixed set of names.
+func SftpOperation(operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	sftpOperations.WithLabelValues(operation, result).Inc()
+	sftpDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
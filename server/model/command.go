@@ -0,0 +1,30 @@
+package model
+
+import (
+	"quick-terminal/server/common"
+)
+
+// Command is a command line found in a recording, Offset is in seconds from
+// the start of the recording and PlaybackUrl streams the recording from
+// shortly before it. Indexed commands are stored with the recording's
+// metadata so that they are searched without reading the recordings.
+type Command struct {
+	ID          uint            `gorm:"primaryKey" json:"-"`
+	RecordingId string          `gorm:"index;type:varchar(200)" json:"recordingId"`
+	SessionId   string          `gorm:"index;type:varchar(200)" json:"sessionId"`
+	Target      string          `gorm:"type:varchar(200)" json:"target"`
+	Username    string          `gorm:"type:varchar(200)" json:"username"`
+	Principal   string          `gorm:"index;type:varchar(200)" json:"principal"`
+	Time        common.JsonTime `gorm:"index" json:"time"`
+	Offset      float64         `json:"offset"`
+	Command     string          `json:"command"`
+	PlaybackUrl string          `gorm:"-" json:"playbackUrl"`
+}
+
+// IndexedRecording marks a recording whose commands are stored, recordings
+// without commands are marked as well so that they are not read again.
+type IndexedRecording struct {
+	ID           string          `gorm:"primaryKey;type:varchar(200)" json:"id"`
+	CommandCount int64           `json:"commandCount"`
+	IndexedTime  common.JsonTime `json:"indexedTime"`
+}
@@ -0,0 +1,25 @@
+package model
+
+import (
+	"quick-terminal/server/common"
+)
+
+// LiveSession describes a connected session for the session inventory.
+type LiveSession struct {
+	ID           string          `json:"id"`
+	Protocol     string          `json:"protocol"`
+	Mode         string          `json:"mode"`
+	Target       string          `json:"target"`
+	Hostname     string          `json:"hostname"`
+	Username     string          `json:"username"`
+	Principal    string          `json:"principal"`
+	ClientIP     string          `json:"clientIp"`
+	StartTime    common.JsonTime `json:"startTime"`
+	Uptime       int64           `json:"uptime"` // seconds
+	BytesIn      int64           `json:"bytesIn"`
+	BytesOut     int64           `json:"bytesOut"`
+	Observers    int             `json:"observers"`
+	Participants int             `json:"participants"`
+	Channels     int             `json:"channels"`
+	Idle         int64           `json:"idle"` // seconds since the last input
+}
@@ -0,0 +1,29 @@
+package model
+
+import (
+	"quick-terminal/server/common"
+)
+
+const (
+	RecordingAsciicast = "asciicast"
+	RecordingGuac      = "guac"
+)
+
+// Recording describes a session recording, the part known when the session
+// starts is stored next to it as meta.json.
+type Recording struct {
+	ID        string          `json:"id"`
+	SessionId string          `json:"sessionId"`
+	Protocol  string          `json:"protocol"`
+	Target    string          `json:"target"`
+	Username  string          `json:"username"`
+	Principal string          `json:"principal"`
+	Format    string          `json:"format"`
+	StartTime common.JsonTime `json:"startTime"`
+	Duration  float64         `json:"duration"` // seconds
+	Size      int64           `json:"size"`
+	Segments  int             `json:"segments,omitempty"`
+	// CommandCount is filled in once the recording was indexed
+	CommandCount int64  `json:"commandCount"`
+	Path         string `json:"-"`
+}
@@ -4,25 +4,31 @@ import (
 	"quick-terminal/server/common"
 )
 
+// Session is a connection through the gateway, it is stored as the session
+// history. Credentials are never stored, SessionId is the id the client
+// connected with and is reused by reconnects.
 type Session struct {
-	ID               string          `gorm:"primary_key,type:varchar(36)" json:"id"`
+	ID               string          `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	SessionId        string          `gorm:"index;type:varchar(200)" json:"sessionId"`
 	Protocol         string          `gorm:"type:varchar(20)" json:"protocol"`
 	IP               string          `gorm:"type:varchar(200)" json:"ip"`
 	Port             int             `json:"port"`
 	ConnectionId     string          `gorm:"type:varchar(50)" json:"connectionId"`
-	AssetId          string          `gorm:"index,type:varchar(36)" json:"assetId"`
+	AssetId          string          `gorm:"index;type:varchar(36)" json:"assetId"`
 	Username         string          `gorm:"type:varchar(200)" json:"username"`
-	Password         string          `gorm:"type:varchar(500)" json:"password"`
-	Creator          string          `gorm:"index,type:varchar(36)" json:"creator"`
+	Password         string          `gorm:"-" json:"password,omitempty"`
+	Creator          string          `gorm:"index;type:varchar(36)" json:"creator"`
+	Principal        string          `gorm:"index;type:varchar(200)" json:"principal"`
 	ClientIP         string          `gorm:"type:varchar(200)" json:"clientIp"`
 	Width            int             `json:"width"`
 	Height           int             `json:"height"`
-	Status           string          `gorm:"index,type:varchar(20)" json:"status"`
+	Status           string          `gorm:"index;type:varchar(20)" json:"status"`
 	Recording        string          `gorm:"type:varchar(1000)" json:"recording"`
-	PrivateKey       string          `gorm:"type:text" json:"privateKey"`
-	Passphrase       string          `gorm:"type:varchar(500)" json:"passphrase"`
+	PrivateKey       string          `gorm:"-" json:"privateKey,omitempty"`
+	Passphrase       string          `gorm:"-" json:"passphrase,omitempty"`
 	Code             int             `json:"code"`
 	Message          string          `json:"message"`
+	CreatedTime      common.JsonTime `gorm:"index" json:"createdTime"`
 	ConnectedTime    common.JsonTime `json:"connectedTime"`
 	DisconnectedTime common.JsonTime `json:"disconnectedTime"`
 
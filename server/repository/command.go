@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"time"
+
+	"quick-terminal/server/common"
+	"quick-terminal/server/model"
+
+	"gorm.io/gorm"
+)
+
+var CommandRepository = new(commandRepository)
+
+type commandRepository struct {
+}
+
+// CommandQuery selects indexed commands, empty fields match anything. Text
+// is a substring unless Regex is set, Target is a substring. Targets and
+// Owner restrict the commands like in SessionQuery.
+type CommandQuery struct {
+	Text      string
+	Regex     bool
+	SessionId string
+	Username  string
+	Principal string
+	Target    string
+	From      time.Time
+	To        time.Time
+	Targets   []string
+	Owner     string
+	Limit     int
+}
+
+// IndexedRecordings returns the ids of the indexed recordings.
+func (r commandRepository) IndexedRecordings() (map[string]bool, error) {
+	var ids []string
+	if err := DB.Model(&model.IndexedRecording{}).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	indexed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		indexed[id] = true
+	}
+	return indexed, nil
+}
+
+// CountByRecording returns the number of commands of an indexed recording,
+// false if it was not indexed yet.
+func (r commandRepository) CountByRecording(recordingId string) (int64, bool) {
+	var indexed model.IndexedRecording
+	if err := DB.Where("id = ?", recordingId).Limit(1).Find(&indexed).Error; err != nil || indexed.ID == "" {
+		return 0, false
+	}
+	return indexed.CommandCount, true
+}
+
+// Index stores the commands of a recording, counts them in the history
+// record of its session and marks the recording as indexed.
+func (r commandRepository) Index(recordingId string, commands []model.Command) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("recording_id = ?", recordingId).Delete(&model.Command{}).Error; err != nil {
+			return err
+		}
+		if len(commands) > 0 {
+			if err := tx.CreateInBatches(commands, 500).Error; err != nil {
+				return err
+			}
+		}
+		err := tx.Model(&model.Session{}).Where("recording = ?", recordingId).Update("command_count", len(commands)).Error
+		if err != nil {
+			return err
+		}
+		return tx.Save(&model.IndexedRecording{
+			ID:           recordingId,
+			CommandCount: int64(len(commands)),
+			IndexedTime:  common.NowJsonTime(),
+		}).Error
+	})
+}
+
+// DeleteByRecording forgets the commands of a removed recording.
+func (r commandRepository) DeleteByRecording(recordingId string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("recording_id = ?", recordingId).Delete(&model.Command{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", recordingId).Delete(&model.IndexedRecording{}).Error
+	})
+}
+
+// Find returns the matching commands, newest first.
+func (r commandRepository) Find(query CommandQuery) ([]model.Command, error) {
+	db := DB.Model(&model.Command{})
+	if query.Text != "" {
+		if query.Regex {
+			db = db.Where("command REGEXP ?", query.Text)
+		} else {
+			db = db.Where("instr(command, ?) > 0", query.Text)
+		}
+	}
+	if query.SessionId != "" {
+		db = db.Where("session_id = ?", query.SessionId)
+	}
+	if query.Username != "" {
+		db = db.Where("username = ?", query.Username)
+	}
+	if query.Principal != "" {
+		db = db.Where("principal = ?", query.Principal)
+	}
+	if query.Target != "" {
+		db = db.Where("instr(target, ?) > 0", query.Target)
+	}
+	if !query.From.IsZero() {
+		db = db.Where("time >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		db = db.Where("time <= ?", query.To)
+	}
+	if len(query.Targets) > 0 || query.Owner != "" {
+		db = db.Where(access("target", query.Targets, query.Owner))
+	}
+	if query.Limit > 0 {
+		db = db.Limit(query.Limit)
+	}
+	items := make([]model.Command, 0)
+	err := db.Order("time desc").Find(&items).Error
+	return items, err
+}
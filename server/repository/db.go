@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"sync/atomic"
+
+	"quick-terminal/server/model"
+	"quick-terminal/server/utils"
+
+	sqlite3 "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DB is the embedded database, nil when it is disabled.
+var DB *gorm.DB
+
+func init() {
+	// Queries filter by auditor targets with the matcher used outside the database
+	sqlite3.MustRegisterDeterministicScalarFunction("match_host", 2, func(ctx *sqlite3.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return utils.MatchHost(text(args[0]), text(args[1])), nil
+	})
+	// X REGEXP Y calls regexp(Y, X)
+	sqlite3.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite3.FunctionContext, args []driver.Value) (driver.Value, error) {
+		re, err := compileRegexp(text(args[0]))
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(text(args[1])), nil
+	})
+}
+
+// lastRegexp caches the pattern of the last query, it is matched against
+// every row.
+var lastRegexp atomic.Value
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := lastRegexp.Load().(*regexp.Regexp); ok && re.String() == pattern {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	lastRegexp.Store(re)
+	return re, nil
+}
+
+func text(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// Init opens the SQLite database at path and migrates its tables.
+func Init(path string) error {
+	db, err := gorm.Open(sqlite.Open(path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&model.Session{}, &model.Command{}, &model.IndexedRecording{}); err != nil {
+		return err
+	}
+	DB = db
+	return nil
+}
+
+// Close closes the database if it is open.
+func Close() error {
+	if DB == nil {
+		return nil
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"time"
+
+	"quick-terminal/server/model"
+
+	"gorm.io/gorm"
+)
+
+var SessionRepository = new(sessionRepository)
+
+type sessionRepository struct {
+}
+
+// SessionQuery selects stored sessions, empty fields match anything.
+// Targets are host patterns matched by utils.MatchHost, a session matches
+// one of them or is its principal's own when Owner is set.
+type SessionQuery struct {
+	SessionId string
+	Protocol  string
+	Status    string
+	IP        string
+	Username  string
+	Principal string
+	From      time.Time
+	To        time.Time
+	Targets   []string
+	Owner     string
+	PageIndex int
+	PageSize  int
+}
+
+func (r sessionRepository) Create(s *model.Session) error {
+	return DB.Create(s).Error
+}
+
+// UpdateStatus moves a session from one of statuses to the status in
+// values, it reports whether the session was in one of them.
+func (r sessionRepository) UpdateStatus(id string, statuses []string, values map[string]interface{}) (bool, error) {
+	tx := DB.Model(&model.Session{}).Where("id = ? AND status IN ?", id, statuses).Updates(values)
+	return tx.RowsAffected > 0, tx.Error
+}
+
+func (r sessionRepository) FindById(id string) (*model.Session, error) {
+	var s model.Session
+	if err := DB.Where("id = ?", id).First(&s).Error; err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Find returns a page of the matching sessions, newest first, and the
+// number of matching sessions.
+func (r sessionRepository) Find(query SessionQuery) (items []model.Session, total int64, err error) {
+	db := DB.Model(&model.Session{})
+	if query.SessionId != "" {
+		db = db.Where("session_id = ?", query.SessionId)
+	}
+	if query.Protocol != "" {
+		db = db.Where("protocol = ?", query.Protocol)
+	}
+	if query.Status != "" {
+		db = db.Where("status = ?", query.Status)
+	}
+	if query.IP != "" {
+		db = db.Where("ip LIKE ?", "%"+query.IP+"%")
+	}
+	if query.Username != "" {
+		db = db.Where("username = ?", query.Username)
+	}
+	if query.Principal != "" {
+		db = db.Where("principal = ?", query.Principal)
+	}
+	if !query.From.IsZero() {
+		db = db.Where("created_time >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		db = db.Where("created_time <= ?", query.To)
+	}
+	if len(query.Targets) > 0 || query.Owner != "" {
+		db = db.Where(access("ip", query.Targets, query.Owner))
+	}
+
+	if err = db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	items = make([]model.Session, 0)
+	err = db.Order("created_time desc").
+		Offset((query.PageIndex - 1) * query.PageSize).
+		Limit(query.PageSize).
+		Find(&items).Error
+	return items, total, err
+}
+
+// access matches the rows whose host column matches one of targets, or
+// whose principal is owner.
+func access(column string, targets []string, owner string) *gorm.DB {
+	cond := DB.Where("1 = 0")
+	for _, target := range targets {
+		cond = cond.Or("match_host(?, "+column+")", target)
+	}
+	if owner != "" {
+		cond = cond.Or("principal = ?", owner)
+	}
+	return cond
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"quick-terminal/server/common"
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/common/term"
+	"quick-terminal/server/config"
+	"quick-terminal/server/log"
+	"quick-terminal/server/model"
+	"quick-terminal/server/repository"
+)
+
+var CommandService = new(commandService)
+
+type commandService struct {
+}
+
+// recordingDir returns the directory of a recording, segmented recordings
+// are directories themselves.
+func recordingDir(recording *model.Recording) string {
+	if recording.Segments > 0 {
+		return recording.Path
+	}
+	return path.Dir(recording.Path)
+}
+
+func (service commandService) prompt() *regexp.Regexp {
+	pattern := config.DefaultCommandPrompt
+	if cfg := config.GlobalCfg.Recording; cfg != nil && cfg.CommandPrompt != "" {
+		pattern = cfg.CommandPrompt
+	}
+	prompt, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Warn("invalid command prompt", log.String("prompt", pattern), log.NamedError("err", err))
+		return regexp.MustCompile(config.DefaultCommandPrompt)
+	}
+	return prompt
+}
+
+// Index extracts the commands of a finished asciicast recording.
+func (service commandService) Index(recording *model.Recording) error {
+	reader, err := RecordingService.Open(recording)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	marker := term.DefaultRedactionMarker
+	if cfg := config.GlobalCfg.Recording; cfg != nil && cfg.Redaction != nil && cfg.Redaction.Marker != "" {
+		marker = cfg.Redaction.Marker
+	}
+	commands, err := term.ExtractCommands(reader, service.prompt(), marker)
+	if err != nil {
+		return err
+	}
+	return term.WriteCommands(recordingDir(recording), commands)
+}
+
+// Commands returns the indexed commands of recording, nil if it was not indexed yet.
+func (service commandService) Commands(recording *model.Recording) ([]term.Command, error) {
+	return term.ReadCommands(recordingDir(recording))
+}
+
+// IndexAll indexes the finished asciicast recordings that have no commands
+// file yet, and stores the commands of the recordings not stored yet when
+// the database is enabled. It stops early when ctx is done.
+func (service commandService) IndexAll(ctx context.Context) error {
+	var stored map[string]bool
+	if repository.DB != nil {
+		var err error
+		if stored, err = repository.CommandRepository.IndexedRecordings(); err != nil {
+			return err
+		}
+	}
+	base := RecordingService.GetBaseRecordingPath()
+	dirEntries, err := os.ReadDir(base)
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range dirEntries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !dirEntry.IsDir() || stored[dirEntry.Name()] || term.IsActive(path.Join(base, dirEntry.Name())) {
+			continue
+		}
+		recording, err := RecordingService.GetById(dirEntry.Name())
+		if err != nil {
+			continue
+		}
+		if recording.Format == model.RecordingAsciicast {
+			dir := recordingDir(recording)
+			if _, err := os.Stat(path.Join(dir, term.RecordingCommandsName)); err != nil {
+				if err := service.Index(recording); err != nil {
+					log.Warn("index recording failed", log.String("recording", recording.ID), log.NamedError("err", err))
+					continue
+				}
+				log.Debug("recording indexed", log.String("recording", recording.ID))
+			}
+		}
+		if repository.DB != nil {
+			if err := service.store(recording); err != nil {
+				log.Warn("store recording commands failed", log.String("recording", recording.ID), log.NamedError("err", err))
+			}
+		}
+	}
+	return nil
+}
+
+// store copies the indexed commands of recording to the database.
+func (service commandService) store(recording *model.Recording) error {
+	commands := make([]model.Command, 0)
+	if recording.Format == model.RecordingAsciicast {
+		var err error
+		if commands, err = service.RecordingCommands(recording); err != nil {
+			return err
+		}
+	}
+	return repository.CommandRepository.Index(recording.ID, commands)
+}
+
+// Count returns the number of indexed commands of recording.
+func (service commandService) Count(recording *model.Recording) int64 {
+	if repository.DB != nil {
+		if n, ok := repository.CommandRepository.CountByRecording(recording.ID); ok {
+			return n
+		}
+	}
+	commands, err := service.Commands(recording)
+	if err != nil {
+		return 0
+	}
+	return int64(len(commands))
+}
+
+// RunIndexer indexes new recordings periodically until ctx is done.
+func (service commandService) RunIndexer(ctx context.Context) {
+	cfg := config.GlobalCfg.Recording
+	if cfg == nil || cfg.IndexInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.IndexInterval)
+	defer ticker.Stop()
+	for {
+		if err := service.IndexAll(ctx); err != nil {
+			log.Error("recording indexer failed", log.NamedError("err", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Search returns the matching commands of the recordings principal may
+// view, newest first. Without the database the recordings are read.
+func (service commandService) Search(principal *config.AuthToken, query repository.CommandQuery) ([]model.Command, error) {
+	var re *regexp.Regexp
+	if query.Regex {
+		var err error
+		if re, err = regexp.Compile(query.Text); err != nil {
+			return nil, err
+		}
+	}
+	if repository.DB == nil {
+		return service.scan(principal, query, re)
+	}
+
+	// Like recordings, admins see every command, auditors those of their
+	// targets and everyone their own
+	if principal == nil {
+		return make([]model.Command, 0), nil
+	}
+	if !principal.HasRole(nt.RoleAdmin) && !(principal.HasRole(nt.RoleAuditor) && len(principal.Targets) == 0) {
+		if principal.HasRole(nt.RoleAuditor) {
+			query.Targets = principal.Targets
+		}
+		query.Owner = principal.Name
+	}
+	items, err := repository.CommandRepository.Find(query)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i].PlaybackUrl = playbackUrl(items[i].RecordingId, items[i].Offset)
+	}
+	return items, nil
+}
+
+// scan searches the commands files of the recordings, skipping recordings
+// outside of the time range.
+func (service commandService) scan(principal *config.AuthToken, query repository.CommandQuery, re *regexp.Regexp) ([]model.Command, error) {
+	recordings, err := RecordingService.List()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]model.Command, 0)
+	for i := range recordings {
+		recording := &recordings[i]
+		if recording.Format != model.RecordingAsciicast || !RecordingService.CanView(principal, recording) {
+			continue
+		}
+		if query.SessionId != "" && recording.SessionId != query.SessionId {
+			continue
+		}
+		if query.Username != "" && recording.Username != query.Username {
+			continue
+		}
+		if query.Principal != "" && recording.Principal != query.Principal {
+			continue
+		}
+		if query.Target != "" && !strings.Contains(recording.Target, query.Target) {
+			continue
+		}
+		if !query.To.IsZero() && recording.StartTime.After(query.To) {
+			continue
+		}
+		end := recording.StartTime.Add(time.Duration(recording.Duration * float64(time.Second)))
+		if !query.From.IsZero() && end.Before(query.From) {
+			continue
+		}
+		commands, err := service.RecordingCommands(recording)
+		if err != nil {
+			log.Warn("read commands failed", log.String("recording", recording.ID), log.NamedError("err", err))
+			continue
+		}
+		for _, command := range commands {
+			if !query.From.IsZero() && command.Time.Before(query.From) {
+				continue
+			}
+			if !query.To.IsZero() && command.Time.After(query.To) {
+				continue
+			}
+			if re != nil && !re.MatchString(command.Command) {
+				continue
+			}
+			if re == nil && !strings.Contains(command.Command, query.Text) {
+				continue
+			}
+			items = append(items, command)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Time.After(items[j].Time.Time)
+	})
+	if query.Limit > 0 && len(items) > query.Limit {
+		items = items[:query.Limit]
+	}
+	return items, nil
+}
+
+// RecordingCommands returns the indexed commands of recording in the order they were run.
+func (service commandService) RecordingCommands(recording *model.Recording) ([]model.Command, error) {
+	commands, err := service.Commands(recording)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]model.Command, 0, len(commands))
+	for _, command := range commands {
+		t := recording.StartTime.Add(time.Duration(command.Time * float64(time.Second)))
+		items = append(items, model.Command{
+			RecordingId: recording.ID,
+			SessionId:   recording.SessionId,
+			Target:      recording.Target,
+			Username:    recording.Username,
+			Principal:   recording.Principal,
+			Time:        common.NewJsonTime(t),
+			Offset:      command.Time,
+			Command:     command.Command,
+			PlaybackUrl: playbackUrl(recording.ID, command.Time),
+		})
+	}
+	return items, nil
+}
+
+// playbackUrl streams the recording from a second before the command, so
+// the player shows it being typed.
+func playbackUrl(recordingId string, offset float64) string {
+	from := math.Max(offset-1, 0)
+	return fmt.Sprintf("/quick/recordings/%s/stream?from=%.3f", recordingId, from)
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"quick-terminal/server/common/guacamole"
+	"quick-terminal/server/config"
+	"quick-terminal/server/global/session"
+)
+
+var HealthService = new(healthService)
+
+type healthService struct {
+}
+
+// probeProtocol is selected in guacd handshakes of the readiness check.
+const probeProtocol = "rdp"
+
+const probeTimeout = 3 * time.Second
+
+var startTime = time.Now()
+
+// Check is the result of a readiness check, Error is empty when it passed.
+type Check struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// Ready runs the readiness checks, guacd must complete the first step of a
+// handshake and the recording and drive directories must be writable. The
+// server is no longer ready once it shuts down.
+func (service healthService) Ready() ([]Check, bool) {
+	var draining error
+	if SessionService.Draining() {
+		draining = errors.New("server is shutting down")
+	}
+	checks := []Check{
+		newCheck("sessions", draining),
+		newCheck("guacd", func() error {
+			_, err := service.probeGuacd()
+			return err
+		}()),
+		newCheck("recording", writable(config.GlobalCfg.Guacd.Recording)),
+		newCheck("drive", writable(config.GlobalCfg.Guacd.Drive)),
+	}
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.Error == ""
+	}
+	return checks, ready
+}
+
+func newCheck(name string, err error) Check {
+	check := Check{Name: name}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+func (service healthService) probeGuacd() (guacamole.Instruction, error) {
+	addr := config.GlobalCfg.Guacd.Hostname + ":" + strconv.Itoa(config.GlobalCfg.Guacd.Port)
+	return guacamole.Probe(addr, probeProtocol, probeTimeout)
+}
+
+// writable creates and removes a file in dir.
+func writable(dir string) error {
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	err = f.Close()
+	if e := os.Remove(name); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Diagnostics describes the gateway for operators.
+type Diagnostics struct {
+	Guacd   GuacdDiagnostics   `json:"guacd"`
+	Build   BuildDiagnostics   `json:"build"`
+	Runtime RuntimeDiagnostics `json:"runtime"`
+	Config  ConfigDiagnostics  `json:"config"`
+}
+
+// GuacdDiagnostics is the outcome of a handshake with guacd, Args are the
+// parameters of the probed protocol.
+type GuacdDiagnostics struct {
+	Address  string   `json:"address"`
+	Protocol string   `json:"protocol"`
+	Version  string   `json:"version,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type BuildDiagnostics struct {
+	GoVersion string `json:"goVersion"`
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified"`
+}
+
+type RuntimeDiagnostics struct {
+	StartTime  time.Time `json:"startTime"`
+	Uptime     int64     `json:"uptime"` // seconds
+	Goroutines int       `json:"goroutines"`
+	Sessions   int       `json:"sessions"`
+}
+
+// ConfigDiagnostics lists the settings of the config that are safe to show.
+// Tokens, keys, webhook URLs and secrets are left out, only counted.
+type ConfigDiagnostics struct {
+	Debug          bool                       `json:"debug"`
+	Addr           string                     `json:"addr"`
+	TLS            bool                       `json:"tls"`
+	DrainTimeout   string                     `json:"drainTimeout"`
+	TrustedProxies []string                   `json:"trustedProxies"`
+	Session        SessionConfigDiagnostics   `json:"session"`
+	Recording      RecordingConfigDiagnostics `json:"recording"`
+	Database       bool                       `json:"database"`
+	Webhooks       int                        `json:"webhooks"`
+	Tokens         int                        `json:"tokens"`
+}
+
+type SessionConfigDiagnostics struct {
+	IdleInputTimeout  string `json:"idleInputTimeout"`
+	IdleOutputTimeout string `json:"idleOutputTimeout"`
+	MaxDuration       string `json:"maxDuration"`
+	TimeoutWarning    string `json:"timeoutWarning"`
+}
+
+type RecordingConfigDiagnostics struct {
+	Enabled         bool   `json:"enabled"`
+	Required        bool   `json:"required"`
+	Rules           int    `json:"rules"`
+	Input           bool   `json:"input"`
+	Keystrokes      bool   `json:"keystrokes"`
+	Guacd           string `json:"guacd"`
+	Signed          bool   `json:"signed"`
+	MaxAge          string `json:"maxAge"`
+	MaxSize         int64  `json:"maxSize"`     // MB
+	SegmentSize     int64  `json:"segmentSize"` // MB
+	SegmentDuration string `json:"segmentDuration"`
+	Compress        bool   `json:"compress"`
+}
+
+func (service healthService) configDiagnostics() ConfigDiagnostics {
+	cfg := config.GlobalCfg
+	diagnostics := ConfigDiagnostics{
+		Debug:          cfg.Debug,
+		Addr:           cfg.Server.Addr,
+		TLS:            cfg.Server.Cert != "" && cfg.Server.Key != "",
+		DrainTimeout:   cfg.Server.DrainTimeout.String(),
+		TrustedProxies: cfg.Server.TrustedProxies,
+		Session: SessionConfigDiagnostics{
+			IdleInputTimeout:  cfg.Session.IdleInputTimeout.String(),
+			IdleOutputTimeout: cfg.Session.IdleOutputTimeout.String(),
+			MaxDuration:       cfg.Session.MaxDuration.String(),
+			TimeoutWarning:    cfg.Session.TimeoutWarning.String(),
+		},
+		Database: cfg.Database.Path != "",
+		Webhooks: len(cfg.Events.Webhooks),
+		Tokens:   len(cfg.Auth.Tokens),
+	}
+	if recording := cfg.Recording; recording != nil {
+		diagnostics.Recording = RecordingConfigDiagnostics{
+			Enabled:         recording.Enabled,
+			Required:        recording.Required,
+			Rules:           len(recording.Rules),
+			Input:           recording.Input,
+			Keystrokes:      recording.Keystrokes,
+			Guacd:           recording.Guacd,
+			Signed:          recording.SigningKey != "",
+			MaxAge:          recording.MaxAge.String(),
+			MaxSize:         recording.MaxSize,
+			SegmentSize:     recording.SegmentSize,
+			SegmentDuration: recording.SegmentDuration.String(),
+			Compress:        recording.Compress,
+		}
+	}
+	return diagnostics
+}
+
+func (service healthService) Diagnostics() Diagnostics {
+	var diagnostics Diagnostics
+
+	diagnostics.Guacd.Address = config.GlobalCfg.Guacd.Hostname + ":" + strconv.Itoa(config.GlobalCfg.Guacd.Port)
+	diagnostics.Guacd.Protocol = probeProtocol
+	if args, err := service.probeGuacd(); err != nil {
+		diagnostics.Guacd.Error = err.Error()
+	} else {
+		for _, arg := range args.Args {
+			if strings.HasPrefix(arg, "VERSION") {
+				diagnostics.Guacd.Version = arg
+				continue
+			}
+			diagnostics.Guacd.Args = append(diagnostics.Guacd.Args, arg)
+		}
+	}
+
+	diagnostics.Build.GoVersion = runtime.Version()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		diagnostics.Build.Module = info.Main.Path
+		diagnostics.Build.Version = info.Main.Version
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				diagnostics.Build.Revision = setting.Value
+			case "vcs.time":
+				diagnostics.Build.Time = setting.Value
+			case "vcs.modified":
+				diagnostics.Build.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	diagnostics.Runtime = RuntimeDiagnostics{
+		StartTime:  startTime,
+		Uptime:     int64(time.Since(startTime) / time.Second),
+		Goroutines: runtime.NumGoroutine(),
+		Sessions:   session.GlobalSessionManager.Len(),
+	}
+	diagnostics.Config = service.configDiagnostics()
+	return diagnostics
+}
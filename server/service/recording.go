@@ -0,0 +1,332 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"quick-terminal/server/common/guacamole"
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/common/term"
+	"quick-terminal/server/config"
+	"quick-terminal/server/event"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/log"
+	"quick-terminal/server/model"
+	"quick-terminal/server/repository"
+	"quick-terminal/server/utils"
+
+	"github.com/google/uuid"
+)
+
+var RecordingService = new(recordingService)
+
+type recordingService struct {
+}
+
+func (service recordingService) GetBaseRecordingPath() string {
+	return config.GlobalCfg.Guacd.Recording
+}
+
+// NewRecordingDir returns a directory for a new recording of the session,
+// unique per connection so that reconnects never overwrite a recording.
+func (service recordingService) NewRecordingDir(sessionId string) string {
+	name := fmt.Sprintf("%s-%s-%s", sessionId, time.Now().Format("20060102T150405"), uuid.NewString()[:8])
+	return path.Join(service.GetBaseRecordingPath(), name)
+}
+
+// RecorderOptions returns the segment rotation settings of new recordings.
+func (service recordingService) RecorderOptions() term.RecorderOptions {
+	cfg := config.GlobalCfg.Recording
+	if cfg == nil {
+		return term.RecorderOptions{}
+	}
+	return term.RecorderOptions{
+		SegmentSize:     cfg.SegmentSize * 1024 * 1024,
+		SegmentDuration: cfg.SegmentDuration,
+		Compress:        cfg.Compress,
+		SigningKey:      signingKey,
+	}
+}
+
+var signingKey ed25519.PrivateKey
+
+// LoadSigningKey loads recording.signing-key, it is called on startup so
+// that a key which cannot be loaded fails the start instead of leaving
+// recordings unsigned.
+func (service recordingService) LoadSigningKey() error {
+	file := config.GlobalCfg.Recording.SigningKey
+	if file == "" {
+		return nil
+	}
+	key, err := term.LoadSigningKey(file)
+	if err != nil {
+		return fmt.Errorf("load recording signing key: %w", err)
+	}
+	signingKey = key
+	return nil
+}
+
+var ErrRecordingNotVerifiable = errors.New("recording has no manifest")
+
+// Verify checks recording against its manifest and the configured key. Without
+// a key the signature only proves the manifest is consistent.
+func (service recordingService) Verify(recording *model.Recording) (*term.Verification, error) {
+	dir := recordingDir(recording)
+	if _, err := os.Stat(path.Join(dir, term.RecordingManifestName)); err != nil {
+		return nil, ErrRecordingNotVerifiable
+	}
+	var key ed25519.PublicKey
+	cfg := config.GlobalCfg.Recording
+	if cfg != nil && (cfg.VerifyKey != "" || cfg.SigningKey != "") {
+		file := cfg.VerifyKey
+		if file == "" {
+			file = cfg.SigningKey
+		}
+		var err error
+		if key, err = term.LoadVerifyKey(file); err != nil {
+			return nil, err
+		}
+	}
+	return term.VerifyRecording(dir, key)
+}
+
+// Policy decides whether a session to the target is recorded, and whether it
+// must be refused when the recording cannot be created.
+func (service recordingService) Policy(host string, port int, username string, requested bool) (record bool, required bool) {
+	cfg := config.GlobalCfg.Recording
+	if cfg == nil {
+		return requested, false
+	}
+	record = cfg.Enabled || requested
+	required = cfg.Required
+	for _, rule := range cfg.Rules {
+		if rule.Host != "" {
+			if ok, _ := path.Match(rule.Host, host); !ok {
+				continue
+			}
+		}
+		if rule.Port != 0 && rule.Port != port {
+			continue
+		}
+		if rule.Username != "" && rule.Username != username {
+			continue
+		}
+		record = true
+		required = required || rule.Required
+	}
+	return record, record && required
+}
+
+// RecordsGuacdAtGateway reports whether guacd sessions are recorded by the
+// gateway rather than by guacd.
+func (service recordingService) RecordsGuacdAtGateway() bool {
+	cfg := config.GlobalCfg.Recording
+	return cfg == nil || cfg.Guacd != "guacd"
+}
+
+// NewRedactor returns the input filter for recorders, nil when input events
+// are not recorded.
+func (service recordingService) NewRedactor() (*term.Redactor, error) {
+	cfg := config.GlobalCfg.Recording
+	if cfg == nil || !cfg.Input {
+		return nil, nil
+	}
+	if cfg.Redaction == nil {
+		return term.NewRedactor(nil, true, "")
+	}
+	return term.NewRedactor(cfg.Redaction.Prompts, cfg.Redaction.NoEcho, cfg.Redaction.Marker)
+}
+
+const RecordingMetaName = term.RecordingMetaName
+
+// WriteMeta stores what is known about a recording when it starts.
+func (service recordingService) WriteMeta(dir string, recording model.Recording) error {
+	p, err := json.Marshal(recording)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, RecordingMetaName), p, 0644)
+}
+
+// Finished publishes that the recording in dir of a connection was closed.
+func (service recordingService) Finished(sessionId, connection, dir string) {
+	data := event.Recording{Recording: path.Base(dir)}
+	if _, err := os.Stat(path.Join(dir, term.RecordingManifestName)); errors.Is(err, os.ErrNotExist) {
+		// guacd recordings are sealed once written, asciicast ones by their recorder
+		if err := term.SealRecording(dir, []string{guacamole.RecordingFile, guacamole.KeyLogName}, signingKey); err != nil {
+			log.Warn("seal recording failed", log.String("recording", data.Recording), log.NamedError("err", err))
+		}
+	}
+	if recording, err := service.GetById(data.Recording); err == nil {
+		data.Format = recording.Format
+		data.Size = recording.Size
+		data.Duration = recording.Duration
+	}
+	event.Publish(event.New(event.RecordingFinished, sessionId, connection, data))
+}
+
+// NewKeyLogger starts the keystroke log of a guacd session recorded in dir,
+// nil when keystrokes are not logged.
+func (service recordingService) NewKeyLogger(dir string) (*guacamole.KeyLogger, error) {
+	cfg := config.GlobalCfg.Recording
+	if cfg == nil || !cfg.Keystrokes {
+		return nil, nil
+	}
+	options := guacamole.KeyLogOptions{Marker: term.DefaultRedactionMarker, Clipboard: true}
+	if redaction := cfg.Redaction; redaction != nil {
+		if redaction.Marker != "" {
+			options.Marker = redaction.Marker
+		}
+		options.Clipboard = redaction.Clipboard
+		options.Keystrokes = redaction.Keystrokes
+		options.Window = redaction.KeystrokeWindow
+	}
+	return guacamole.NewKeyLogger(dir, options)
+}
+
+// CanView reports whether principal may view recording. Admins see every
+// recording, auditors those of their targets and everyone their own.
+func (service recordingService) CanView(principal *config.AuthToken, recording *model.Recording) bool {
+	if principal == nil {
+		return false
+	}
+	if principal.HasRole(nt.RoleAdmin) {
+		return true
+	}
+	if principal.HasRole(nt.RoleAuditor) && matchTargets(principal.Targets, recording.Target) {
+		return true
+	}
+	return recording.Principal != "" && recording.Principal == principal.Name
+}
+
+// matchTargets reports whether target, a host with optional port, matches
+// one of the host patterns in targets. No targets match any host.
+func matchTargets(targets []string, target string) bool {
+	if len(targets) == 0 {
+		return true
+	}
+	for _, pattern := range targets {
+		if utils.MatchHost(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type recordingEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// Cleanup removes recordings older than MaxAge, then the oldest recordings
+// until the total size is below MaxSize. Recordings still being written are
+// never touched.
+func (service recordingService) Cleanup() error {
+	cfg := config.GlobalCfg.Recording
+	if cfg == nil || (cfg.MaxAge <= 0 && cfg.MaxSize <= 0) {
+		return nil
+	}
+	base := service.GetBaseRecordingPath()
+	dirEntries, err := os.ReadDir(base)
+	if err != nil {
+		return err
+	}
+
+	// Recordings written by guacd are only known to be live by their session
+	live := make(map[string]bool)
+	session.GlobalSessionManager.Range(func(key string, s *session.Session) {
+		if s.Recording != "" {
+			live[path.Base(s.Recording)] = true
+		}
+		if s.Channels != nil {
+			s.Channels.Range(func(key string, ch *session.Session) {
+				if ch.Recording != "" {
+					live[path.Base(ch.Recording)] = true
+				}
+			})
+		}
+	})
+
+	var entries []recordingEntry
+	var total int64
+	for _, dirEntry := range dirEntries {
+		dir := path.Join(base, dirEntry.Name())
+		if live[dirEntry.Name()] || term.IsActive(dir) || guacamole.IsActive(dir) {
+			continue
+		}
+		entry := recordingEntry{name: dirEntry.Name()}
+		_ = filepath.WalkDir(path.Join(base, dirEntry.Name()), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if !d.IsDir() {
+				entry.size += info.Size()
+			}
+			if info.ModTime().After(entry.modTime) {
+				entry.modTime = info.ModTime()
+			}
+			return nil
+		})
+		entries = append(entries, entry)
+		total += entry.size
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	maxSize := cfg.MaxSize * 1024 * 1024
+	for _, entry := range entries {
+		expired := cfg.MaxAge > 0 && time.Since(entry.modTime) > cfg.MaxAge
+		oversize := maxSize > 0 && total > maxSize
+		if !expired && !oversize {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(base, entry.name)); err != nil {
+			log.Error("remove recording failed", log.String("recording", entry.name), log.NamedError("err", err))
+			continue
+		}
+		total -= entry.size
+		if repository.DB != nil {
+			if err := repository.CommandRepository.DeleteByRecording(entry.name); err != nil {
+				log.Warn("remove recording commands failed", log.String("recording", entry.name), log.NamedError("err", err))
+			}
+		}
+		log.Info("recording removed", log.String("recording", entry.name), log.Bool("expired", expired), log.Int64("size", entry.size))
+	}
+	return nil
+}
+
+// RunCleanup applies the retention policy periodically until ctx is done.
+func (service recordingService) RunCleanup(ctx context.Context) {
+	interval := time.Hour
+	if cfg := config.GlobalCfg.Recording; cfg != nil && cfg.CleanupInterval > 0 {
+		interval = cfg.CleanupInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := service.Cleanup(); err != nil {
+			log.Error("recording cleanup failed", log.NamedError("err", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"quick-terminal/server/common"
+	"quick-terminal/server/common/guacamole"
+	"quick-terminal/server/common/term"
+	"quick-terminal/server/model"
+)
+
+var (
+	ErrRecordingNotFound      = errors.New("recording not found")
+	ErrRecordingNotExportable = errors.New("only asciicast recordings can be exported")
+	ErrKeyLogNotFound         = errors.New("recording has no keystroke log")
+)
+
+// Recording file names, guacd names its files "recording" unless told otherwise.
+var recordingNames = []struct {
+	name   string
+	format string
+}{
+	{"recording.cast", model.RecordingAsciicast},
+	{"recording.guac", model.RecordingGuac},
+	{"recording", model.RecordingGuac},
+}
+
+var guacSync = regexp.MustCompile(`4\.sync,\d+\.(\d+)`)
+
+// List returns the recordings under the recording directory, newest first.
+func (service recordingService) List() ([]model.Recording, error) {
+	dirEntries, err := os.ReadDir(service.GetBaseRecordingPath())
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]model.Recording, 0)
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		recording, err := service.GetById(dirEntry.Name())
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, *recording)
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].StartTime.After(recordings[j].StartTime.Time)
+	})
+	return recordings, nil
+}
+
+func (service recordingService) GetById(id string) (*model.Recording, error) {
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+		return nil, ErrRecordingNotFound
+	}
+	dir := path.Join(service.GetBaseRecordingPath(), id)
+
+	var recording model.Recording
+	if index, err := term.ReadIndex(dir); err == nil && len(index.Segments) > 0 {
+		// Segmented recording, Path is its directory
+		recording.Path = dir
+		recording.Format = model.RecordingAsciicast
+		recording.Segments = len(index.Segments)
+		for _, segment := range index.Segments {
+			recording.Size += segment.Size
+		}
+		recording.Duration = index.Segments[len(index.Segments)-1].End
+		if info, err := os.Stat(dir); err == nil {
+			recording.StartTime = common.NewJsonTime(info.ModTime())
+		}
+	}
+	for _, candidate := range recordingNames {
+		if recording.Path != "" {
+			break
+		}
+		p := path.Join(dir, candidate.name)
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		recording.Path = p
+		recording.Format = candidate.format
+		recording.Size = info.Size()
+		recording.StartTime = common.NewJsonTime(info.ModTime())
+	}
+	if recording.Path == "" {
+		return nil, ErrRecordingNotFound
+	}
+
+	if p, err := os.ReadFile(path.Join(dir, RecordingMetaName)); err == nil {
+		var meta model.Recording
+		if err := json.Unmarshal(p, &meta); err == nil {
+			recording.SessionId = meta.SessionId
+			recording.Protocol = meta.Protocol
+			recording.Target = meta.Target
+			recording.Username = meta.Username
+			recording.Principal = meta.Principal
+			if !meta.StartTime.IsZero() {
+				recording.StartTime = meta.StartTime
+			}
+		}
+	}
+	recording.ID = id
+	if recording.SessionId == "" {
+		recording.SessionId = id
+	}
+
+	switch {
+	case recording.Segments > 0:
+	case recording.Format == model.RecordingAsciicast:
+		recording.Duration = asciicastDuration(recording.Path)
+	case recording.Format == model.RecordingGuac:
+		recording.Duration = guacDuration(recording.Path)
+	}
+	recording.CommandCount = CommandService.Count(&recording)
+	return &recording, nil
+}
+
+// asciicastDuration returns the time of the last event.
+func asciicastDuration(p string) float64 {
+	tail, err := readTail(p, 64*1024)
+	if err != nil {
+		return 0
+	}
+	lines := strings.Split(strings.TrimSpace(string(tail)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &event); err != nil || len(event) == 0 {
+			continue
+		}
+		if t, ok := event[0].(float64); ok {
+			return t
+		}
+	}
+	return 0
+}
+
+// guacDuration returns the time between the first and last sync instruction.
+func guacDuration(p string) float64 {
+	file, err := os.Open(p)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	head := make([]byte, 64*1024)
+	n, _ := io.ReadFull(file, head)
+	first := guacSync.FindSubmatch(head[:n])
+	if first == nil {
+		return 0
+	}
+	tail, err := readTail(p, 64*1024)
+	if err != nil {
+		return 0
+	}
+	all := guacSync.FindAllSubmatch(tail, -1)
+	if len(all) == 0 {
+		return 0
+	}
+	start, _ := strconv.ParseInt(string(first[1]), 10, 64)
+	end, _ := strconv.ParseInt(string(all[len(all)-1][1]), 10, 64)
+	return float64(end-start) / 1000
+}
+
+func readTail(p string, size int64) ([]byte, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - size
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(file)
+}
+
+// Open returns the content of recording, segments are joined into one stream.
+func (service recordingService) Open(recording *model.Recording) (io.ReadCloser, error) {
+	if recording.Segments > 0 {
+		return term.OpenRecording(recording.Path)
+	}
+	return os.Open(recording.Path)
+}
+
+// StreamAsciicast writes the recording starting at from seconds and ending
+// at to seconds, zero meaning the end. Output before from is replayed on a
+// screen and sent as a single event redrawing it, so that a player shows
+// the right screen right away without the whole output being held.
+func (service recordingService) StreamAsciicast(w io.Writer, flush func(), recording *model.Recording, from, to float64) error {
+	file, err := service.Open(recording)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	header, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// Output before from is replayed on a screen, the stream starts with a
+	// redraw of it rather than with all the output
+	var screen *term.Screen
+	var resize interface{}
+	seeking := from > 0
+	if seeking {
+		var h term.Header
+		_ = json.Unmarshal(header, &h)
+		screen = term.NewScreen(h.Width, h.Height)
+	}
+	lines := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var event []interface{}
+			if json.Unmarshal(line, &event) == nil && len(event) == 3 {
+				t, _ := event[0].(float64)
+				code, _ := event[1].(string)
+				if to > 0 && t > to {
+					break
+				}
+				if seeking && t < from {
+					switch code {
+					case "o":
+						data, _ := event[2].(string)
+						screen.Write(data)
+					case "r":
+						resize = event[2]
+						size, _ := event[2].(string)
+						if cols, rows, ok := term.ParseSize(size); ok {
+							screen.Resize(cols, rows)
+						}
+					}
+					continue
+				}
+				if seeking {
+					seeking = false
+					if err := writeSeekEvents(w, from, resize, screen.Snapshot()); err != nil {
+						return err
+					}
+				}
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if lines++; lines%100 == 0 {
+				flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if seeking {
+		if err := writeSeekEvents(w, from, resize, screen.Snapshot()); err != nil {
+			return err
+		}
+	}
+	flush()
+	return nil
+}
+
+func writeSeekEvents(w io.Writer, from float64, resize interface{}, prelude string) error {
+	events := make([][]interface{}, 0, 2)
+	if resize != nil {
+		events = append(events, []interface{}{from, "r", resize})
+	}
+	if prelude != "" {
+		events = append(events, []interface{}{from, "o", prelude})
+	}
+	for _, event := range events {
+		p, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(p, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamGuac writes a .guac recording up to to seconds. The sync
+// instructions before from are dropped, so the player renders everything
+// before it as a single frame.
+func (service recordingService) StreamGuac(w io.Writer, flush func(), recording *model.Recording, from, to float64) error {
+	file, err := os.Open(recording.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := guacamole.NewInstructionReader(file)
+	var start int64 = -1
+	instructions := 0
+	for {
+		raw, instruction, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if instruction.Opcode == "sync" && len(instruction.Args) > 0 {
+			timestamp, _ := strconv.ParseInt(instruction.Args[0], 10, 64)
+			if start < 0 {
+				start = timestamp
+			}
+			elapsed := float64(timestamp-start) / 1000
+			if to > 0 && elapsed > to {
+				break
+			}
+			if elapsed < from {
+				continue
+			}
+		}
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+		if instructions++; instructions%500 == 0 {
+			flush()
+		}
+	}
+	flush()
+	return nil
+}
+
+// Export writes an asciicast recording as a plain text transcript, format
+// "text", or as a self-contained HTML player, format "html".
+func (service recordingService) Export(w io.Writer, recording *model.Recording, format string) error {
+	if recording.Format != model.RecordingAsciicast {
+		return ErrRecordingNotExportable
+	}
+	reader, err := service.Open(recording)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if format == "html" {
+		commands, _ := CommandService.Commands(recording)
+		title := fmt.Sprintf("%s@%s %s", recording.Username, recording.Target, recording.StartTime.Format("2006-01-02 15:04:05"))
+		return term.WriteHtml(w, reader, title, commands)
+	}
+	return term.WriteTranscript(w, reader)
+}
+
+// KeyLogPath returns the keystroke log of a guacd recording.
+func (service recordingService) KeyLogPath(recording *model.Recording) (string, error) {
+	file := path.Join(recordingDir(recording), guacamole.KeyLogName)
+	if _, err := os.Stat(file); err != nil {
+		return "", ErrKeyLogNotFound
+	}
+	return file, nil
+}
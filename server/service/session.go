@@ -1,11 +1,15 @@
 package service
 
 import (
+	"encoding/base64"
 	"quick-terminal/server/common/guacamole"
 	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+	"quick-terminal/server/dto"
 	"quick-terminal/server/global/session"
-	"strconv"
+	"quick-terminal/server/metrics"
 	"sync"
+	"sync/atomic"
 )
 
 var SessionService = new(sessionService)
@@ -15,24 +19,85 @@ type sessionService struct {
 
 var mutex sync.Mutex
 
+var (
+	// draining is set once the server shuts down, no sessions are accepted then
+	draining int32
+	// handlers counts the running handlers of sessions
+	handlers int64
+)
+
+// Enter admits the handler of a new session, it reports false when the
+// server shuts down. Admitted handlers call Leave when they return.
+func (service sessionService) Enter() bool {
+	atomic.AddInt64(&handlers, 1)
+	if atomic.LoadInt32(&draining) == 1 {
+		atomic.AddInt64(&handlers, -1)
+		return false
+	}
+	return true
+}
+
+func (service sessionService) Leave() {
+	atomic.AddInt64(&handlers, -1)
+}
+
+// Handlers returns the number of running session handlers.
+func (service sessionService) Handlers() int64 {
+	return atomic.LoadInt64(&handlers)
+}
+
+// Drain stops admitting new sessions.
+func (service sessionService) Drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+func (service sessionService) Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
 func (service sessionService) WriteCloseMessage(sess *session.Session, mode string, code int, reason string) {
 	switch mode {
 	case nt.Guacd:
-		err := guacamole.NewInstruction("error", "", strconv.Itoa(code))
-		_ = sess.WriteString(err.String())
-		disconnect := guacamole.NewInstruction("disconnect")
-		_ = sess.WriteString(disconnect.String())
+		sess.Disconnect(code, reason)
 	case nt.Native, nt.Terminal:
-		msg := `0` + reason
-		_ = sess.WriteString(msg)
+		msg := dto.NewMessage(dto.Closed, reason)
+		msg.Code = code
+		_ = sess.WriteMessage(msg)
 	}
 }
 
+func (service sessionService) WriteNoticeMessage(sess *session.Session, mode string, level, notice string) {
+	switch mode {
+	case nt.Guacd:
+		// The web client shows notice instructions, encoded like errors
+		instruction := guacamole.NewInstruction("notice", level, base64.StdEncoding.EncodeToString([]byte(notice)))
+		_ = sess.WriteString(instruction.String())
+	case nt.Native, nt.Terminal:
+		msg := dto.NewMessage(dto.Notice, notice)
+		msg.Level = level
+		_ = sess.WriteMessage(msg)
+	}
+}
+
+// CanObserve reports whether principal may watch a live session. Admins may
+// watch every session, auditors those of their targets.
+func (service sessionService) CanObserve(principal *config.AuthToken, sess *session.Session) bool {
+	if principal == nil {
+		return false
+	}
+	if principal.HasRole(nt.RoleAdmin) {
+		return true
+	}
+	return principal.HasRole(nt.RoleAuditor) && matchTargets(principal.Targets, sess.Target)
+}
+
 func (service sessionService) CloseSessionById(sessionId string, code int, reason string) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	nextSession := session.GlobalSessionManager.GetById(sessionId)
 	if nextSession != nil {
+		metrics.SessionClosed(code)
+		service.HistoryDisconnected(nextSession.History, code, reason)
 		service.WriteCloseMessage(nextSession, nextSession.Mode, code, reason)
 
 		if nextSession.Observer != nil {
@@ -40,6 +105,26 @@ func (service sessionService) CloseSessionById(sessionId string, code int, reaso
 				service.WriteCloseMessage(ob, ob.Mode, code, reason)
 			})
 		}
+
+		if nextSession.Channels != nil {
+			nextSession.Channels.Range(func(key string, ch *session.Session) {
+				service.WriteCloseMessage(ch, ch.Mode, code, reason)
+			})
+		}
 	}
 	session.GlobalSessionManager.Del(sessionId)
 }
+
+func (service sessionService) CloseChannelById(sessionId, channelId string, code int, reason string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	nextSession := session.GlobalSessionManager.GetById(sessionId)
+	if nextSession == nil || nextSession.Channels == nil {
+		return
+	}
+	channel := nextSession.Channels.GetById(channelId)
+	if channel != nil {
+		service.WriteCloseMessage(channel, channel.Mode, code, reason)
+	}
+	nextSession.Channels.Del(channelId)
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"quick-terminal/server/common"
+	"quick-terminal/server/common/nt"
+	"quick-terminal/server/config"
+	"quick-terminal/server/event"
+	"quick-terminal/server/log"
+	"quick-terminal/server/model"
+	"quick-terminal/server/repository"
+
+	"github.com/google/uuid"
+)
+
+type connection struct {
+	sessionId string
+	data      event.Session
+}
+
+// connections holds the connections not yet disconnected by their id.
+var connections sync.Map
+
+// NewHistory stores a connection attempt in the session history, publishes
+// it and returns the id of the connection. Credentials are stripped.
+func (service sessionService) NewHistory(s model.Session) string {
+	record := s
+	record.ID = uuid.NewString()
+	record.SessionId = s.ID
+	record.Password = ""
+	record.PrivateKey = ""
+	record.Passphrase = ""
+	record.Recording = ""
+	record.Status = nt.Connecting
+	record.CreatedTime = common.NowJsonTime()
+	if repository.DB != nil {
+		if err := repository.SessionRepository.Create(&record); err != nil {
+			log.Warn("create session history failed", log.String("sessionId", s.ID), log.NamedError("err", err))
+		}
+	}
+
+	data := event.Session{
+		Protocol:  s.Protocol,
+		Mode:      s.Mode,
+		Target:    net.JoinHostPort(s.IP, strconv.Itoa(s.Port)),
+		Username:  s.Username,
+		Principal: s.Principal,
+		ClientIP:  s.ClientIP,
+	}
+	connections.Store(record.ID, &connection{sessionId: s.ID, data: data})
+	event.Publish(event.New(event.SessionCreated, s.ID, record.ID, data))
+	return record.ID
+}
+
+// HistoryConnected records that a connection is up, recording is the
+// directory it is recorded in, empty if it is not.
+func (service sessionService) HistoryConnected(id string, recording string) {
+	value, ok := connections.Load(id)
+	if !ok {
+		return
+	}
+	conn := value.(*connection)
+	data := conn.data
+	if recording != "" {
+		data.Recording = path.Base(recording)
+	}
+	event.Publish(event.New(event.SessionConnected, conn.sessionId, id, data))
+	if repository.DB == nil {
+		return
+	}
+	values := map[string]interface{}{
+		"status":         nt.Connected,
+		"connected_time": time.Now(),
+	}
+	if recording != "" {
+		values["recording"] = data.Recording
+	}
+	_, err := repository.SessionRepository.UpdateStatus(id, []string{nt.Connecting}, values)
+	if err != nil {
+		log.Warn("update session history failed", log.String("id", id), log.NamedError("err", err))
+	}
+}
+
+// HistoryDisconnected records the close code and reason of a connection,
+// only the first close of a connection is recorded and published.
+func (service sessionService) HistoryDisconnected(id string, code int, reason string) {
+	value, ok := connections.LoadAndDelete(id)
+	if !ok {
+		return
+	}
+	conn := value.(*connection)
+	event.Publish(event.New(event.SessionDisconnected, conn.sessionId, id, event.Disconnected{Code: code, Reason: reason}))
+	if repository.DB == nil {
+		return
+	}
+	_, err := repository.SessionRepository.UpdateStatus(id, []string{nt.Connecting, nt.Connected}, map[string]interface{}{
+		"status":            nt.Disconnected,
+		"disconnected_time": time.Now(),
+		"code":              code,
+		"message":           reason,
+	})
+	if err != nil {
+		log.Warn("update session history failed", log.String("id", id), log.NamedError("err", err))
+	}
+}
+
+// History returns a page of the history records principal may view, like
+// recordings admins see every record, auditors those of their targets and
+// everyone their own.
+func (service sessionService) History(principal *config.AuthToken, query repository.SessionQuery) ([]model.Session, int64, error) {
+	if !principal.HasRole(nt.RoleAdmin) && !(principal.HasRole(nt.RoleAuditor) && len(principal.Targets) == 0) {
+		if principal.HasRole(nt.RoleAuditor) {
+			query.Targets = principal.Targets
+		}
+		query.Owner = principal.Name
+	}
+	return repository.SessionRepository.Find(query)
+}
+
+// HistoryById returns a history record, nil if principal may not view it.
+func (service sessionService) HistoryById(principal *config.AuthToken, id string) (*model.Session, error) {
+	record, err := repository.SessionRepository.FindById(id)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.HasRole(nt.RoleAdmin) &&
+		!(principal.HasRole(nt.RoleAuditor) && matchTargets(principal.Targets, record.IP)) &&
+		(record.Principal == "" || record.Principal != principal.Name) {
+		return nil, nil
+	}
+	return record, nil
+}
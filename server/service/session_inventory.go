@@ -0,0 +1,167 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"quick-terminal/server/common"
+	"quick-terminal/server/global/session"
+	"quick-terminal/server/model"
+	"quick-terminal/server/utils"
+)
+
+// SessionQuery selects live sessions like SessionFilter does, ClientIP is a
+// pattern like Target and Mode matches exactly. Sort names a field of
+// model.LiveSession, sessions are sorted by start time by default.
+type SessionQuery struct {
+	SessionFilter
+	Mode     string
+	ClientIP string
+	Sort     string
+	Desc     bool
+}
+
+var sessionSorts = map[string]func(a, b *model.LiveSession) bool{
+	"id":        func(a, b *model.LiveSession) bool { return a.ID < b.ID },
+	"protocol":  func(a, b *model.LiveSession) bool { return a.Protocol < b.Protocol },
+	"mode":      func(a, b *model.LiveSession) bool { return a.Mode < b.Mode },
+	"target":    func(a, b *model.LiveSession) bool { return a.Target < b.Target },
+	"username":  func(a, b *model.LiveSession) bool { return a.Username < b.Username },
+	"principal": func(a, b *model.LiveSession) bool { return a.Principal < b.Principal },
+	"clientIp":  func(a, b *model.LiveSession) bool { return a.ClientIP < b.ClientIP },
+	"startTime": func(a, b *model.LiveSession) bool { return a.StartTime.Before(b.StartTime.Time) },
+	"bytesIn":   func(a, b *model.LiveSession) bool { return a.BytesIn < b.BytesIn },
+	"bytesOut":  func(a, b *model.LiveSession) bool { return a.BytesOut < b.BytesOut },
+	"observers": func(a, b *model.LiveSession) bool { return a.Observers < b.Observers },
+	"idle":      func(a, b *model.LiveSession) bool { return a.Idle < b.Idle },
+}
+
+// ValidSessionSort reports whether sessions can be sorted by field.
+func ValidSessionSort(field string) bool {
+	_, ok := sessionSorts[field]
+	return field == "" || ok
+}
+
+// List returns the live sessions matching query.
+func (service sessionService) List(query SessionQuery) []model.LiveSession {
+	items := make([]model.LiveSession, 0)
+	session.GlobalSessionManager.Range(func(key string, s *session.Session) {
+		if !query.Match(s) {
+			return
+		}
+		if query.Mode != "" && s.Mode != query.Mode {
+			return
+		}
+		if query.ClientIP != "" && !utils.MatchHost(query.ClientIP, s.ClientIP) {
+			return
+		}
+		items = append(items, service.liveSession(s))
+	})
+
+	less, ok := sessionSorts[query.Sort]
+	if !ok {
+		less = sessionSorts["startTime"]
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if query.Desc {
+			return less(&items[j], &items[i])
+		}
+		return less(&items[i], &items[j])
+	})
+	return items
+}
+
+func (service sessionService) liveSession(s *session.Session) model.LiveSession {
+	item := model.LiveSession{
+		ID:        s.ID,
+		Protocol:  s.Protocol,
+		Mode:      s.Mode,
+		Target:    s.Target,
+		Hostname:  s.Hostname,
+		Username:  s.Username,
+		Principal: s.Principal,
+		ClientIP:  s.ClientIP,
+		StartTime: common.NewJsonTime(s.ConnectedTime),
+		Uptime:    int64(time.Since(s.ConnectedTime) / time.Second),
+		BytesIn:   s.BytesIn(),
+		BytesOut:  s.BytesOut(),
+		Idle:      int64(time.Since(s.LastInput()) / time.Second),
+	}
+	if s.Observer != nil {
+		s.Observer.Range(func(key string, ob *session.Session) {
+			if ob.Share != "" {
+				item.Participants++
+			} else {
+				item.Observers++
+			}
+		})
+	}
+	if s.Channels != nil {
+		item.Channels = s.Channels.Len()
+	}
+	return item
+}
+
+// SessionFilter selects the sessions an administrative action applies to.
+// Target is a host pattern like the targets of auditors, the other fields
+// match exactly and empty fields match anything.
+type SessionFilter struct {
+	Target    string `json:"target"`
+	Username  string `json:"username"`
+	Principal string `json:"principal"`
+	Protocol  string `json:"protocol"`
+}
+
+func (filter SessionFilter) Empty() bool {
+	return filter == SessionFilter{}
+}
+
+func (filter SessionFilter) Match(s *session.Session) bool {
+	if filter.Target != "" && !matchTargets([]string{filter.Target}, s.Target) {
+		return false
+	}
+	if filter.Username != "" && s.Username != filter.Username {
+		return false
+	}
+	if filter.Principal != "" && s.Principal != filter.Principal {
+		return false
+	}
+	return filter.Protocol == "" || s.Protocol == filter.Protocol
+}
+
+// Sessions returns the live sessions matching filter.
+func (service sessionService) Sessions(filter SessionFilter) []*session.Session {
+	var sessions []*session.Session
+	session.GlobalSessionManager.Range(func(key string, s *session.Session) {
+		if filter.Match(s) {
+			sessions = append(sessions, s)
+		}
+	})
+	return sessions
+}
+
+// ObserveActive calls observe with the protocol and mode of every live
+// session, it feeds the active sessions gauge.
+func (service sessionService) ObserveActive(observe func(protocol, mode string)) {
+	session.GlobalSessionManager.Range(func(key string, s *session.Session) {
+		observe(s.Protocol, s.Mode)
+	})
+}
+
+// Broadcast shows notice in the sessions matching filter, including their
+// channels, observers and participants. It returns the number of sessions.
+func (service sessionService) Broadcast(filter SessionFilter, level, notice string) int {
+	sessions := service.Sessions(filter)
+	for _, s := range sessions {
+		service.WriteNoticeMessage(s, s.Mode, level, notice)
+		for _, m := range []*session.Manager{s.Channels, s.Observer} {
+			if m == nil {
+				continue
+			}
+			m.Range(func(key string, sub *session.Session) {
+				service.WriteNoticeMessage(sub, sub.Mode, level, notice)
+			})
+		}
+	}
+	return len(sessions)
+}
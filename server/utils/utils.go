@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
 )
 
@@ -44,3 +46,15 @@ func DecodePayload(encodedPayload string) (map[string]interface{}, error) {
 	err = json.Unmarshal(payloadStr, &payload)
 	return payload, err
 }
+
+// MatchHost reports whether target, a host with optional port, matches the
+// path.Match pattern. Auditor targets are matched with it everywhere, the
+// database calls it as match_host.
+func MatchHost(pattern, target string) bool {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
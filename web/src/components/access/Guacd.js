@@ -97,6 +97,17 @@ const Guacd = () => {
         let tunnel = new Guacamole.WebSocketTunnel(`${wsServer}/quick/${sessionId}/tunnel`);
         let client = new Guacamole.Client(tunnel);
 
+        // Notices of the server are not part of the Guacamole protocol, the
+        // client ignores them
+        const handleInstruction = tunnel.oninstruction;
+        tunnel.oninstruction = (opcode, args) => {
+            if (opcode === 'notice') {
+                showNotice(args[0], Base64.decode(args[1]));
+                return;
+            }
+            handleInstruction(opcode, args);
+        };
+
         // Handle clipboard contents received from virtual machine
         client.onclipboard = handleClipboardReceived;
 
@@ -342,6 +353,19 @@ const Guacd = () => {
         message.success('Key(s) sent');
     }
 
+    const showNotice = (level, notice) => {
+        switch (level) {
+            case 'error':
+                message.error({content: notice, duration: 10});
+                break;
+            case 'warning':
+                message.warning({content: notice, duration: 10});
+                break;
+            default:
+                message.info({content: notice, duration: 10});
+        }
+    }
+
     const showMessage = (msg) => {
         message.destroy();
         Modal.confirm({
@@ -13,6 +13,9 @@ const Message = class Message {
     static Data = 2;
     static Resize = 3;
     static Ping = 4;
+    static ZmodemStart = 5;
+    static ZmodemEnd = 6;
+    static Notice = 9;
 
     static parse(s) {
         let type = parseInt(s.substring(0, 1));
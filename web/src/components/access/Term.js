@@ -138,6 +138,8 @@ const Term = () => {
             'cols': term.cols,
             'rows': term.rows,
             'payload': payloadParam,
+            // ZMODEM transfers are sent as binary frames instead of terminal output
+            'zmodem': true,
         };
 
         let paramStr = qs.stringify(params);
@@ -171,6 +173,10 @@ const Term = () => {
         });
 
         webSocket.onmessage = (e) => {
+            if (typeof e.data !== 'string') {
+                // Frames of a ZMODEM transfer, it is canceled on ZmodemStart
+                return;
+            }
             let msg = Message.parse(e.data);
             switch (msg['type']) {
                 case Message.Connected:
@@ -184,6 +190,16 @@ const Term = () => {
                     term.writeln(`\x1B[1;3;31m${msg['content']}\x1B[0m `);
                     webSocket.close();
                     break;
+                case Message.Notice:
+                    message.warning({content: msg['content'], duration: 10});
+                    break;
+                case Message.ZmodemStart:
+                    // The browser does not speak ZMODEM, cancel the rz/sz transfer
+                    webSocket.send(new Message(Message.ZmodemEnd, "").toString());
+                    message.warning({content: 'ZMODEM transfers are not supported here, use the file manager', duration: 10});
+                    break;
+                case Message.ZmodemEnd:
+                    break;
                 default:
                     break;
             }